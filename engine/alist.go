@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,51 +14,341 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type AlistClient struct {
 	Endpoint *url.URL
+	// Username and Password log in to Alist, and renew the token once it is rejected.
+	Username string
+	Password string
+	// Token is a static token to use before logging in, if any.
+	Token string
+	// Passwords maps paths to passwords of protected folders under them.
+	Passwords map[string]string
+	// RateLimits maps lower-cased storage providers to their rate limits. The limit of
+	// "default" applies to other providers, and paths of providers not known yet.
+	RateLimits map[string]*RateLimit
 
 	client *http.Client
+	// providers maps paths to their storage providers, as known from responses. A path
+	// takes the provider of its nearest known ancestor.
+	providers sync.Map
+	// buckets maps storage providers to their token buckets.
+	buckets sync.Map
+
+	mu    sync.Mutex
+	token string
 }
 
-func (c *AlistClient) get(path string) (*AlistGetResult, error) {
+// password returns the password of the folder containing path, by the longest
+// matching path of c.Passwords.
+func (c *AlistClient) password(path string) string {
+	var matched, password string
+	for prefix, each := range c.Passwords {
+		if dir := strings.TrimSuffix(prefix, "/"); path != dir && !strings.HasPrefix(path, dir+"/") {
+			continue
+		}
+		if len(prefix) > len(matched) {
+			matched, password = prefix, each
+		}
+	}
+	return password
+}
+
+// Errors of Alist requests, by the code and message Alist answers.
+var (
+	// ErrNotFound is returned when the path does not exist on Alist. It is the only error
+	// telling a strm target is gone.
+	ErrNotFound = fmt.Errorf("not found on Alist: %w", fs.ErrNotExist)
+	// ErrUnauthorized is returned when Alist rejects the token, or the folder password.
+	ErrUnauthorized = errors.New("unauthorized by Alist")
+	// ErrRateLimited is returned when Alist or its storage throttles requests.
+	ErrRateLimited = errors.New("rate limited by Alist")
+	// ErrStorageUnavailable is returned when the storage of the path is not loaded.
+	ErrStorageUnavailable = errors.New("storage unavailable on Alist")
+)
+
+// AlistError is an error answered by Alist in the response body.
+type AlistError struct {
+	Code    int
+	Message string
+	// Err is one of the errors above, or nil if the error is not known.
+	Err error
+}
+
+func (e *AlistError) Error() string {
+	return fmt.Sprintf("alist: %d %s", e.Code, e.Message)
+}
+
+func (e *AlistError) Unwrap() error {
+	return e.Err
+}
+
+// alistError returns the error of a response code and message of Alist, or nil on
+// success.
+func alistError(code int, message string) error {
+	if code == http.StatusOK {
+		return nil
+	}
+	e := &AlistError{Code: code, Message: message}
+	msg := strings.ToLower(message)
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden,
+		strings.Contains(msg, "password is incorrect"):
+		e.Err = ErrUnauthorized
+	case code == http.StatusTooManyRequests, strings.Contains(msg, "rate limit"),
+		strings.Contains(msg, "too many requests"), strings.Contains(msg, "频繁"):
+		e.Err = ErrRateLimited
+	case strings.Contains(msg, "storage"):
+		// E.g. "storage not found; please add a storage first", "storage not init".
+		e.Err = ErrStorageUnavailable
+	case strings.Contains(msg, "not found"), strings.Contains(msg, "not exist"):
+		e.Err = ErrNotFound
+	}
+	return e
+}
+
+// statusError returns the error of an HTTP status other than 200.
+func statusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%s: %w", resp.Status, ErrRateLimited)
+	}
+	return errors.New(resp.Status)
+}
+
+// authToken returns the token to authorize requests, logging in first if there is no
+// token but credentials.
+func (c *AlistClient) authToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" {
+		c.token = c.Token
+	}
+	if c.token == "" && c.Username != "" {
+		if err := c.login(ctx); err != nil {
+			return "", err
+		}
+	}
+	return c.token, nil
+}
+
+// renewToken logs in again to replace a rejected token, unless it is already replaced
+// by another request.
+func (c *AlistClient) renewToken(ctx context.Context, rejected string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != rejected {
+		return nil
+	}
+	if c.Username == "" {
+		return ErrUnauthorized
+	}
+	return c.login(ctx)
+}
+
+// login logs in with username and password. c.mu must be held.
+func (c *AlistClient) login(ctx context.Context) error {
+	u := *c.Endpoint
+	u.Path = "api/auth/login"
+
+	p, _ := json.Marshal(AlistLoginPayload{
+		Username: c.Username,
+		Password: c.Password,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", GlobalUserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("login to Alist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login to Alist: %s", resp.Status)
+	}
+	r := &AlistLoginResult{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return fmt.Errorf("login to Alist: %w", err)
+	}
+	if r.Code != http.StatusOK || r.Data == nil || r.Data.Token == "" {
+		return fmt.Errorf("login to Alist: %d %s", r.Code, r.Message)
+	}
+	c.token = r.Data.Token
+	return nil
+}
+
+// authorized calls request with a token, and again with a renewed token if Alist answers
+// an auth error code. Errors of auth are returned as *fs.PathError of op and path.
+func (c *AlistClient) authorized(ctx context.Context, op, path string, request func(token string) (code int, err error)) error {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	code, err := request(token)
+	if err != nil || code != http.StatusUnauthorized {
+		return err
+	}
+	if err := c.renewToken(ctx, token); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	if token, err = c.authToken(ctx); err != nil {
+		return &fs.PathError{Op: op, Path: path, Err: err}
+	}
+	if code, err = request(token); err != nil {
+		return err
+	}
+	if code == http.StatusUnauthorized {
+		return &fs.PathError{Op: op, Path: path, Err: ErrUnauthorized}
+	}
+	return nil
+}
+
+// provider returns the storage provider of path, or empty if not known yet.
+func (c *AlistClient) provider(path string) string {
+	for p := path; ; p = filepath.Dir(p) {
+		if v, ok := c.providers.Load(p); ok {
+			return v.(string)
+		}
+		if p == "/" || p == "." {
+			return ""
+		}
+	}
+}
+
+// learnProvider records the storage provider of path. The first provider known under a
+// root directory is taken by its other paths until known.
+func (c *AlistClient) learnProvider(path, provider string) {
+	if provider == "" {
+		return
+	}
+	if c.provider(path) != provider {
+		c.providers.Store(path, provider)
+	}
+	c.providers.LoadOrStore("/"+rootLabel(path), provider)
+}
+
+// bucket returns the token bucket of the storage provider of path, or nil if no rate
+// limit is configured.
+func (c *AlistClient) bucket(path string) *tokenBucket {
+	if len(c.RateLimits) == 0 {
+		return nil
+	}
+	provider := c.provider(path)
+	if provider == "" {
+		provider = "unknown"
+	}
+	if v, ok := c.buckets.Load(provider); ok {
+		return v.(*tokenBucket)
+	}
+	limit := c.RateLimits[strings.ToLower(provider)]
+	if limit == nil {
+		limit = c.RateLimits[defaultRateLimitProvider]
+	}
+	if limit == nil {
+		limit = builtinRateLimit
+	}
+	v, _ := c.buckets.LoadOrStore(provider, newTokenBucket(provider, limit))
+	return v.(*tokenBucket)
+}
+
+// limited calls request once the rate limit of the storage provider of path allows, and
+// adjusts the rate by its result.
+func (c *AlistClient) limited(ctx context.Context, path string, request func() error) error {
+	b := c.bucket(path)
+	if b == nil {
+		return request()
+	}
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	err := request()
+	b.done(ctx, err)
+	return err
+}
+
+func (c *AlistClient) get(ctx context.Context, path string) (*AlistGetResult, error) {
+	var r *AlistGetResult
+	err := c.limited(ctx, path, func() error {
+		err := c.authorized(ctx, "Get", path, func(token string) (int, error) {
+			var err error
+			r, err = c.requestGet(ctx, path, token)
+			if err != nil {
+				return 0, err
+			}
+			return r.Code, nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := alistError(r.Code, r.Message); err != nil {
+			return &fs.PathError{Op: "Get", Path: path, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.Data != nil {
+		c.learnProvider(path, r.Data.Provider)
+	}
+	return r, nil
+}
+
+func (c *AlistClient) requestGet(ctx context.Context, path, token string) (*AlistGetResult, error) {
 	u := *c.Endpoint
 	u.Path = "api/fs/get"
 
 	p, _ := json.Marshal(AlistGetPayload{
-		Path: path,
+		Path:     path,
+		Password: c.password(path),
 	})
 
-	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(p))
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(p))
 	if err != nil {
 		return nil, &fs.PathError{Op: "Get", Path: path, Err: err}
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", GlobalUserAgent)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
 
 	var resp *http.Response
 	for range 3 {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
 		resp, err = c.client.Do(req)
 		if err != nil {
 			if err, ok := err.(*url.Error); ok {
 				err := err.Err
 				_, ok := err.(*net.OpError)
 				if ok || err == io.EOF {
-					time.Sleep(time.Second * 10)
+					sleepContext(ctx, time.Second*10)
 					continue
 				}
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			err = errors.New(resp.Status)
-			time.Sleep(time.Second * 3)
+			err = statusError(resp)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		break
@@ -78,13 +369,13 @@ func (c *AlistClient) get(path string) (*AlistGetResult, error) {
 	return r, nil
 }
 
-func (c *AlistClient) Stat(path string) (os.FileInfo, error) {
-	r, err := c.get(path)
+func (c *AlistClient) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	r, err := c.get(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 	if r.Data == nil {
-		return nil, fs.ErrNotExist
+		return nil, &fs.PathError{Op: "Get", Path: path, Err: ErrNotFound}
 	}
 	return AlistFile{
 		path:     path,
@@ -95,44 +386,97 @@ func (c *AlistClient) Stat(path string) (os.FileInfo, error) {
 	}, nil
 }
 
-func (c *AlistClient) list(path string, page, perPage int) (*AlistListResult, error) {
+func (c *AlistClient) list(ctx context.Context, path string, page, perPage int) (*AlistListResult, error) {
+	var (
+		r     *AlistListResult
+		start time.Time
+	)
+	err := c.limited(ctx, path, func() error {
+		start = time.Now()
+		err := c.authorized(ctx, "List", path, func(token string) (int, error) {
+			var err error
+			r, err = c.requestList(ctx, path, page, perPage, token)
+			if err != nil {
+				return 0, err
+			}
+			return r.Code, nil
+		})
+		if err == nil {
+			if e := alistError(r.Code, r.Message); e != nil {
+				err = &fs.PathError{Op: "List", Path: path, Err: e}
+			}
+		}
+		return err
+	})
+	if err != nil {
+		r = nil
+	}
+	if start.IsZero() {
+		// Canceled while waiting for the rate limit.
+		return nil, err
+	}
+
+	if err == nil && r.Data != nil {
+		c.learnProvider(path, r.Data.Provider)
+	}
+	provider := c.provider(path)
+	if provider == "" {
+		provider = "unknown"
+	}
+	metricAlistRequests.WithLabelValues(provider).Inc()
+	metricAlistLatency.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+	if err != nil && ctx.Err() == nil {
+		metricAlistErrors.WithLabelValues(provider).Inc()
+	}
+	return r, err
+}
+
+func (c *AlistClient) requestList(ctx context.Context, path string, page, perPage int, token string) (*AlistListResult, error) {
 	u := *c.Endpoint
 	u.Path = "api/fs/list"
 
 	p, _ := json.Marshal(AlistListPayload{
-		Path:    path,
-		Page:    page,
-		PerPage: perPage,
+		Path:     path,
+		Page:     page,
+		PerPage:  perPage,
+		Password: c.password(path),
 	})
 
-	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(p))
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(p))
 	if err != nil {
 		return nil, &fs.PathError{Op: "List", Path: path, Err: err}
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", GlobalUserAgent)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
 
 	var resp *http.Response
 	for range 3 {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
 		resp, err = c.client.Do(req)
 		if err != nil {
 			if err, ok := err.(*url.Error); ok {
 				err := err.Err
 				_, ok := err.(*net.OpError)
 				if ok || err == io.EOF {
-					time.Sleep(time.Second * 10)
+					sleepContext(ctx, time.Second*10)
 					continue
 				}
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			err = errors.New(resp.Status)
-			time.Sleep(time.Second * 3)
+			err = statusError(resp)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		break
@@ -153,16 +497,16 @@ func (c *AlistClient) list(path string, page, perPage int) (*AlistListResult, er
 	return r, nil
 }
 
-func (c *AlistClient) ReadDir(path string) ([]os.FileInfo, error) {
+func (c *AlistClient) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
 	var files []os.FileInfo
 	count, total := 0, 1
 	for i := 1; count < total; i++ {
-		r, err := c.list(path, i, 1024)
+		r, err := c.list(ctx, path, i, 1024)
 		if err != nil {
 			return nil, err
 		}
 		if r.Data == nil {
-			return nil, fs.ErrNotExist
+			return nil, &fs.PathError{Op: "List", Path: path, Err: ErrNotFound}
 		}
 		n := len(r.Data.Content)
 		count += n
@@ -182,12 +526,12 @@ func (c *AlistClient) ReadDir(path string) ([]os.FileInfo, error) {
 	return files, nil
 }
 
-func (c *AlistClient) Walk(root string, fn WalkFunc) error {
-	info, err := c.Stat(root)
+func (c *AlistClient) Walk(ctx context.Context, root string, fn WalkFunc) error {
+	info, err := c.Stat(ctx, root)
 	if err != nil {
 		err = fn(root, nil, err)
 	} else {
-		err = c.walk(root, info, fn)
+		err = c.walk(ctx, root, info, fn)
 	}
 	if err == filepath.SkipDir || err == filepath.SkipAll {
 		return nil
@@ -195,12 +539,12 @@ func (c *AlistClient) Walk(root string, fn WalkFunc) error {
 	return err
 }
 
-func (c *AlistClient) walk(path string, info os.FileInfo, walkFn WalkFunc) error {
+func (c *AlistClient) walk(ctx context.Context, path string, info os.FileInfo, walkFn WalkFunc) error {
 	if !info.IsDir() {
 		return walkFn(path, info, nil)
 	}
 
-	fileInfos, err := c.ReadDir(path)
+	fileInfos, err := c.ReadDir(ctx, path)
 	err1 := walkFn(path, info, err)
 	// If err != nil, walk can't walk into this directory.
 	// err1 != nil means walkFn want walk to skip this directory or stop walking.
@@ -215,7 +559,7 @@ func (c *AlistClient) walk(path string, info os.FileInfo, walkFn WalkFunc) error
 	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
 
 	for _, fileInfo := range fileInfos {
-		err = c.walk(filepath.Join(path, fileInfo.Name()), fileInfo, walkFn)
+		err = c.walk(ctx, filepath.Join(path, fileInfo.Name()), fileInfo, walkFn)
 		if err != nil {
 			if !fileInfo.IsDir() || err != filepath.SkipDir {
 				return err
@@ -227,6 +571,21 @@ func (c *AlistClient) walk(path string, info os.FileInfo, walkFn WalkFunc) error
 
 type WalkFunc func(path string, info os.FileInfo, err error) error
 
+type AlistLoginPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AlistLoginResult struct {
+	Code    int                   `json:"code"`
+	Data    *AlistLoginResultData `json:"data"`
+	Message string                `json:"message"`
+}
+
+type AlistLoginResultData struct {
+	Token string `json:"token"`
+}
+
 type AlistGetPayload struct {
 	Path     string `json:"path"`
 	Password string `json:"password"`
@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAlistClientPassword(t *testing.T) {
+	c := &AlistClient{Passwords: map[string]string{
+		"/a":     "pa",
+		"/a/b/":  "pab",
+		"/a/b/c": "pabc",
+	}}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a", "pa"},
+		{"/a/x", "pa"},
+		{"/a/b", "pab"},
+		{"/a/b/x", "pab"},
+		{"/a/b/c", "pabc"},
+		{"/a/b/c/x", "pabc"},
+		{"/a/bc", "pa"},
+		{"/ab", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		if got := c.password(tt.path); got != tt.want {
+			t.Errorf("password(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAlistError(t *testing.T) {
+	tests := []struct {
+		code    int
+		message string
+		want    error
+	}{
+		{500, "password is incorrect or you have no permission", ErrUnauthorized},
+		{401, "token is expired", ErrUnauthorized},
+		{403, "forbidden", ErrUnauthorized},
+		{429, "", ErrRateLimited},
+		{500, "failed get objs: rate limit exceeded", ErrRateLimited},
+		{500, "Too Many Requests", ErrRateLimited},
+		{500, "请求过于频繁", ErrRateLimited},
+		{500, "storage not init: /115", ErrStorageUnavailable},
+		{500, "storage not found; please add a storage first", ErrStorageUnavailable},
+		{500, "failed get objs: object not found", ErrNotFound},
+		{500, "file not exist", ErrNotFound},
+		{500, "unexpected failure", nil},
+	}
+	for _, tt := range tests {
+		err := alistError(tt.code, tt.message)
+		var e *AlistError
+		if !errors.As(err, &e) {
+			t.Errorf("alistError(%d, %q) = %v, want *AlistError", tt.code, tt.message, err)
+			continue
+		}
+		if e.Code != tt.code || e.Message != tt.message || e.Err != tt.want {
+			t.Errorf("alistError(%d, %q) = %+v, want Err %v", tt.code, tt.message, e, tt.want)
+		}
+	}
+
+	if err := alistError(200, "success"); err != nil {
+		t.Errorf("alistError(200) = %v, want nil", err)
+	}
+	if err := alistError(500, "object not found"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("alistError of not found = %v, want fs.ErrNotExist", err)
+	}
+}
+
+// alistStub stands in for Alist, serving a folder of a single file protected by a
+// password. Tokens other than token are rejected.
+type alistStub struct {
+	*httptest.Server
+
+	token    string
+	password string
+
+	mu     sync.Mutex
+	logins int
+}
+
+func newAlistStub(t *testing.T, token, password string) *alistStub {
+	s := &alistStub{token: token, password: password}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *alistStub) serve(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	if r.URL.Path == "/api/auth/login" {
+		var p AlistLoginPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		s.mu.Lock()
+		s.logins++
+		s.mu.Unlock()
+		if p.Username != "admin" || p.Password != "secret" {
+			enc.Encode(map[string]any{"code": 400, "message": "password is incorrect"})
+			return
+		}
+		enc.Encode(map[string]any{"code": 200, "message": "success", "data": map[string]any{"token": s.token}})
+		return
+	}
+	if r.Header.Get("Authorization") != s.token {
+		enc.Encode(map[string]any{"code": 401, "message": "token is invalidated"})
+		return
+	}
+
+	var p AlistListPayload
+	json.NewDecoder(r.Body).Decode(&p)
+	switch {
+	case p.Path != "/电影" && p.Path != "/电影/a.mkv":
+		enc.Encode(map[string]any{"code": 500, "message": "object not found"})
+	case p.Password != s.password:
+		enc.Encode(map[string]any{"code": 403, "message": "password is incorrect or you have no permission"})
+	case r.URL.Path == "/api/fs/list":
+		enc.Encode(map[string]any{"code": 200, "message": "success", "data": map[string]any{
+			"provider": "115 Cloud",
+			"total":    1,
+			"content": []map[string]any{
+				{"name": "a.mkv", "size": 42, "is_dir": false, "modified": "2024-01-02T03:04:05Z"},
+			},
+		}})
+	case r.URL.Path == "/api/fs/get":
+		enc.Encode(map[string]any{"code": 200, "message": "success", "data": map[string]any{
+			"name": "a.mkv", "size": 42, "is_dir": false, "modified": "2024-01-02T03:04:05Z", "provider": "115 Cloud",
+		}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// loginCount returns the number of logins received.
+func (s *alistStub) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func TestAlistClient(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(t *testing.T, stub *alistStub) *AlistClient {
+		c, err := NewAlistClient(stub.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Token = "static"
+		c.Passwords = map[string]string{"/电影": "folder"}
+		return c
+	}
+
+	t.Run("renew token", func(t *testing.T) {
+		stub := newAlistStub(t, "t2", "folder")
+		c := newClient(t, stub)
+		c.Username, c.Password = "admin", "secret"
+
+		for range 2 {
+			files, err := c.ReadDir(ctx, "/电影")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Name() != "a.mkv" || files[0].Size() != 42 {
+				t.Errorf("ReadDir = %v, want a.mkv of 42 bytes", files)
+			}
+		}
+		if n := stub.loginCount(); n != 1 {
+			t.Errorf("logins = %d, want 1", n)
+		}
+		if got := c.provider("/电影/a.mkv"); got != "115 Cloud" {
+			t.Errorf("provider = %q, want 115 Cloud", got)
+		}
+	})
+
+	t.Run("token rejected without credentials", func(t *testing.T) {
+		stub := newAlistStub(t, "t2", "folder")
+		c := newClient(t, stub)
+
+		if _, err := c.ReadDir(ctx, "/电影"); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("ReadDir = %v, want ErrUnauthorized", err)
+		}
+		if n := stub.loginCount(); n != 0 {
+			t.Errorf("logins = %d, want 0", n)
+		}
+	})
+
+	t.Run("folder password", func(t *testing.T) {
+		stub := newAlistStub(t, "static", "folder")
+		c := newClient(t, stub)
+
+		c.Passwords = map[string]string{"/电影": "wrong"}
+		if _, err := c.ReadDir(ctx, "/电影"); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("ReadDir = %v, want ErrUnauthorized", err)
+		}
+		c.Passwords = map[string]string{"/": "wrong", "/电影/": "folder"}
+		if _, err := c.Stat(ctx, "/电影/a.mkv"); err != nil {
+			t.Errorf("Stat = %v, want nil", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		stub := newAlistStub(t, "static", "folder")
+		c := newClient(t, stub)
+
+		_, err := c.Stat(ctx, "/电影/gone.mkv")
+		if !errors.Is(err, ErrNotFound) || !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat = %v, want ErrNotFound", err)
+		}
+	})
+}
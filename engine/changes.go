@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Actions of files changed in media directory.
+const (
+	ChangeAdded   = "added"
+	ChangeUpdated = "updated"
+	ChangeRemoved = "removed"
+)
+
+// Reasons of files changed in media directory.
+const (
+	reasonNewOnMirror      = "new on mirror"
+	reasonNewerOnMirror    = "newer on mirror"
+	reasonStrmURLChanged   = "strm url changed"
+	reasonAbsentOnAlist    = "absent on Alist"
+	reasonUnknownOnAlist   = "unknown on Alist"
+	reasonNoLongerOnMirror = "no longer on mirror"
+)
+
+// changeTimeLayout keeps times of changes sortable as text.
+const changeTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Change is a file added, updated or removed in media directory by a run. Sizes and
+// ETags are absent for the side that does not exist, and ETags are absent for strm files.
+type Change struct {
+	ID      int64     `json:"id"`
+	RunID   string    `json:"run_id"`
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Action  string    `json:"action"`
+	OldSize *int64    `json:"old_size,omitempty"`
+	NewSize *int64    `json:"new_size,omitempty"`
+	OldETag string    `json:"old_etag,omitempty"`
+	NewETag string    `json:"new_etag,omitempty"`
+	Reason  string    `json:"reason"`
+}
+
+// changeFilter selects changes to list.
+type changeFilter struct {
+	// Action and Prefix of path are matched if not empty.
+	Action string
+	Prefix string
+	// Since and Until bound the time of changes if not zero.
+	Since time.Time
+	Until time.Time
+	// Before is the ID to list changes older than, for paging.
+	Before int64
+	Limit  int
+}
+
+// removalReason returns why a strm file is removed from media directory, by its verdict.
+// Other files are only removed once no longer on mirror.
+func removalReason(strm string, verdicts map[string]string) string {
+	switch verdicts[strm] {
+	case VerdictAbsent:
+		return reasonAbsentOnAlist
+	case VerdictUnknown:
+		return reasonUnknownOnAlist
+	}
+	return reasonNoLongerOnMirror
+}
+
+func createChangeTable(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT,
+		time TEXT,
+		path TEXT,
+		action TEXT,
+		old_size INTEGER,
+		new_size INTEGER,
+		old_etag TEXT,
+		new_etag TEXT,
+		reason TEXT
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS changes_path ON changes (path)"); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS changes_time ON changes (time)")
+	return err
+}
+
+// saveChanges appends changes in tx. Changes are never updated or deleted.
+func saveChanges(tx *sql.Tx, changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO changes (run_id, time, path, action, old_size, new_size, old_etag, new_etag, reason) VALUES (?,?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, c := range changes {
+		if _, err := stmt.Exec(c.RunID, c.Time.UTC().Format(changeTimeLayout), c.Path, c.Action,
+			c.OldSize, c.NewSize, c.OldETag, c.NewETag, c.Reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listChanges returns changes selected by f, newest first.
+func (cfg *Config) listChanges(f changeFilter) ([]*Change, error) {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var (
+		conds []string
+		args  []any
+	)
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Prefix != "" {
+		conds = append(conds, "substr(path, 1, length(?)) = ?")
+		args = append(args, f.Prefix, f.Prefix)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "time >= ?")
+		args = append(args, f.Since.UTC().Format(changeTimeLayout))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "time < ?")
+		args = append(args, f.Until.UTC().Format(changeTimeLayout))
+	}
+	if f.Before > 0 {
+		conds = append(conds, "id < ?")
+		args = append(args, f.Before)
+	}
+	query := "SELECT id, run_id, time, path, action, old_size, new_size, COALESCE(old_etag, ''), COALESCE(new_etag, ''), COALESCE(reason, '') FROM changes"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*Change{}
+	for rows.Next() {
+		var (
+			c                = &Change{}
+			t                string
+			oldSize, newSize sql.NullInt64
+		)
+		if err := rows.Scan(&c.ID, &c.RunID, &t, &c.Path, &c.Action, &oldSize, &newSize, &c.OldETag, &c.NewETag, &c.Reason); err != nil {
+			return nil, err
+		}
+		if c.Time, err = time.Parse(changeTimeLayout, t); err != nil {
+			return nil, err
+		}
+		if oldSize.Valid {
+			c.OldSize = &oldSize.Int64
+		}
+		if newSize.Valid {
+			c.NewSize = &newSize.Int64
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// printChanges prints changes as a table.
+func printChanges(w io.Writer, changes []*Change) error {
+	size := func(n *int64) string {
+		if n == nil {
+			return "-"
+		}
+		return strconv.FormatInt(*n, 10)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTION\tOLD SIZE\tNEW SIZE\tREASON\tRUN ID\tPATH")
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Time.Local().Format(time.DateTime), c.Action, size(c.OldSize), size(c.NewSize), c.Reason, c.RunID, c.Path)
+	}
+	return tw.Flush()
+}
+
+// parseTime parses a time of command line in RFC 3339, "2006-01-02 15:04:05" or
+// "2006-01-02" in local timezone, or a duration ago such as "24h".
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
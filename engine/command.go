@@ -0,0 +1,386 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const exitCodesHelp = `
+Exit codes:
+  0    Success, or stopped gracefully.
+  2    Invalid options.
+  3    Directories are locked by another instance.
+  125  Metadata download failed.
+  126  Alist verification failed.
+  127  Media purge failed.
+  128  Media sync failed.
+  130  Shutdown timed out.`
+
+func (cfg *Config) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "xiaoya-emby",
+		Short:   "Xiaoya utility for Emby",
+		Long:    `Utility to maintain metadata files in xiaoya media library for Emby` + "\n" + exitCodesHelp,
+		Version: Version,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if err := cfg.loadConfig(cmd); err != nil {
+				return err
+			}
+			return cfg.setupLogging()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(stagesFromMode(cfg.RunMode), cfg.RunAsDaemon)
+		},
+	}
+	var version bool
+	cmd.PersistentFlags().StringVarP(&cfg.ConfigFile, "config", "c", "", "Load options from a YAML or TOML file. Precedence: flags > XIAOYA_EMBY_* env vars > config file.")
+	cfg.bindLogFlags(cmd.PersistentFlags())
+	cmd.Flags().IntVar(&cfg.RunMode, "mode", 7, "Run mode (4: scan metadata, 2: verify strm files on Alist, 1: sync metadata). Prefer subcommands instead.")
+	cmd.Flags().BoolVar(&cfg.RunAsDaemon, "daemon", true, "Run as daemon in foreground.")
+	cmd.Flags().BoolVarP(&cfg.Help, "help", "h", false, "Print this message.")
+	cmd.Flags().BoolVarP(&version, "version", "v", false, "Print software version.")
+	cfg.bindScheduleFlags(cmd.Flags())
+	cfg.bindDownloadFlags(cmd.Flags())
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindMediaFlags(cmd.Flags())
+	cfg.bindPurgeFlags(cmd.Flags())
+	cfg.bindReportFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), stagesAll)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	cfg.bindMediaServerFlags(cmd.Flags())
+
+	cmd.AddCommand(
+		cfg.downloadCommand(),
+		cfg.verifyCommand(),
+		cfg.purgeCommand(),
+		cfg.syncCommand(),
+		cfg.runOnceCommand(),
+		cfg.daemonCommand(),
+		cfg.historyCommand(),
+		cfg.changesCommand(),
+	)
+	return cmd
+}
+
+func (cfg *Config) downloadCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "download",
+		Short: "Download metadata from mirrors",
+		Long:  `Download metadata from mirrors to download directory.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StageDownload, false)
+		},
+	}
+	cfg.bindDownloadFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), StageDownload)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) verifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify strm files against Alist",
+		Long:  `Verify targets of strm files in download directory against Alist, without changing media directory. Verdicts are recorded, and count towards --purge-after-absent of later purges.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StageVerify, false)
+		},
+	}
+	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindReportFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), StageVerify)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) purgeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Purge unavailable media from media directory",
+		Long:  `Verify strm files against Alist, then remove files no longer available from media directory.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StageVerify|StagePurge, false)
+		},
+	}
+	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	cmd.Flags().StringVarP(&cfg.MediaDir, "media-dir", "d", "/media", "Media directory of Emby to maintain metadata.")
+	cfg.bindPurgeFlags(cmd.Flags())
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), StageVerify|StagePurge)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	cfg.bindMediaServerFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) syncCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Sync downloaded metadata to media directory",
+		Long:  `Sync metadata in download directory to media directory, without downloading from mirrors.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StagePurge|StageSync, false)
+		},
+	}
+	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindMediaFlags(cmd.Flags())
+	cfg.bindPurgeFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), StageVerify|StagePurge|StageSync)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	cfg.bindMediaServerFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) runOnceCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run-once",
+		Short: "Download and sync metadata once",
+		Long:  `Download metadata from mirrors, then sync it to media directory.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StageDownload|StagePurge|StageSync, false)
+		},
+	}
+	cfg.bindDownloadFlags(cmd.Flags())
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindMediaFlags(cmd.Flags())
+	cfg.bindPurgeFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), stagesAll)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	cfg.bindMediaServerFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) daemonCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Download and sync metadata as scheduled",
+		Long:  `Run in foreground, download metadata from mirrors and sync it to media directory as scheduled.` + "\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg.execute(StageDownload|StagePurge|StageSync, true)
+		},
+	}
+	cfg.bindScheduleFlags(cmd.Flags())
+	cfg.bindDownloadFlags(cmd.Flags())
+	cfg.bindAlistFlags(cmd.Flags())
+	cfg.bindMediaFlags(cmd.Flags())
+	cfg.bindPurgeFlags(cmd.Flags())
+	cfg.bindRetryFlags(cmd.Flags(), stagesAll)
+	cfg.bindRuntimeFlags(cmd.Flags())
+	cfg.bindNotifyFlags(cmd.Flags())
+	cfg.bindMediaServerFlags(cmd.Flags())
+	return cmd
+}
+
+func (cfg *Config) historyCommand() *cobra.Command {
+	var (
+		limit  int
+		asJSON bool
+	)
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Print recent runs",
+		Long:  `Print recent runs of the pipeline recorded in state DB of download directory, newest first.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if limit < 1 {
+				return fmt.Errorf("limit must be at least 1: %d", limit)
+			}
+			runs, err := cfg.listRuns(limit)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(runs)
+			}
+			return printRuns(cmd.OutOrStdout(), runs)
+		},
+	}
+	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	cmd.Flags().IntVarP(&limit, "limit", "n", 20, "Number of runs to print.")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print runs in JSON, including per-stage durations and valid directories per root.")
+	return cmd
+}
+
+func (cfg *Config) changesCommand() *cobra.Command {
+	var (
+		filter       changeFilter
+		since, until string
+		asJSON       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "changes",
+		Short: "Print files changed in media directory",
+		Long:  `Print files added, updated and removed in media directory, with the reason and the run, as recorded in state DB of download directory, newest first.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if filter.Limit < 1 {
+				return fmt.Errorf("limit must be at least 1: %d", filter.Limit)
+			}
+			switch filter.Action {
+			case "", ChangeAdded, ChangeUpdated, ChangeRemoved:
+			default:
+				return fmt.Errorf("invalid action: %s", filter.Action)
+			}
+			if since != "" {
+				if filter.Since, err = parseTime(since); err != nil {
+					return err
+				}
+			}
+			if until != "" {
+				if filter.Until, err = parseTime(until); err != nil {
+					return err
+				}
+			}
+			changes, err := cfg.listChanges(filter)
+			if err != nil {
+				return err
+			}
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+				return enc.Encode(changes)
+			}
+			return printChanges(cmd.OutOrStdout(), changes)
+		},
+	}
+	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	cmd.Flags().StringVar(&since, "since", "", "Print changes since this time, e.g. \"2024-01-02\", \"2024-01-02 15:04:05\", RFC 3339, or a duration ago such as \"24h\".")
+	cmd.Flags().StringVar(&until, "until", "", "Print changes before this time, in the same formats as --since.")
+	cmd.Flags().StringVar(&filter.Prefix, "prefix", "", "Print changes of paths with this prefix, e.g. \"/电影/\".")
+	cmd.Flags().StringVar(&filter.Action, "action", "", "Print changes of this action: \"added\", \"updated\" or \"removed\".")
+	cmd.Flags().IntVarP(&filter.Limit, "limit", "n", 100, "Number of changes to print.")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print changes in JSON, including ETags.")
+	return cmd
+}
+
+func (cfg *Config) bindScheduleFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&cfg.RunCron, "cron-expr", "0 0 * * *", "Cron expression as scheduled task. Must run as daemon.")
+	flags.StringVar(&cfg.CronTimezone, "cron-tz", "", "Timezone of cron expression, e.g. \"Asia/Shanghai\". Defaults to local timezone.")
+	flags.DurationVar(&cfg.CronJitter, "cron-jitter", 0, "Delay scheduled task by a random duration up to this value.")
+	flags.StringVar(&cfg.StartupRun, "startup-run", StartupRunMissed, "When to run on startup: \"always\", \"missed\" (no successful run since the last scheduled time) or \"never\".")
+	flags.StringVar(&cfg.Listen, "listen", "", "Address to serve HTTP API and Prometheus metrics on, e.g. \":5680\". Disabled if empty.")
+	flags.StringVar(&cfg.APIToken, "api-token", "", "Bearer token required by HTTP API, except health checks and metrics. Run, pause, resume and cancel are disabled without it.")
+	flags.StringVar(&cfg.DownloadCron, "download-cron", "", "Cron expression of download stage, or \"off\". Defaults to --cron-expr.")
+	flags.StringVar(&cfg.VerifyCron, "verify-cron", "", "Cron expression of verify stage, or \"off\". Defaults to --cron-expr.")
+	flags.StringVar(&cfg.SyncCron, "sync-cron", "", "Cron expression of purge and sync stages, or \"off\". Defaults to --cron-expr.")
+	flags.StringSliceVar(&cfg.SyncAfter, "sync-after", nil, "Also run purge and sync stages after any successful run of these stages: \"download\", \"verify\".")
+}
+
+func (cfg *Config) bindDownloadFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
+	flags.BoolVar(&cfg.Cleanup, "cleanup", false, "Cleanup downloaded metadata when file no longer exists on remote server.")
+	flags.StringSliceVarP(&cfg.MirrorURL, "mirror-url", "m", nil, "Specify the mirror URL to sync metadata from.")
+}
+
+func (cfg *Config) bindAlistFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&cfg.AlistURL, "alist-url", "u", defaultAlistEndpoint, "Endpoint of xiaoya Alist. Change this value will result to url overide in strm file.")
+	flags.StringVar(&cfg.AlistUsername, "alist-username", "", "Username to log in to Alist, if guest access is disabled.")
+	flags.StringVar(&cfg.AlistPassword, "alist-password", "", "Password to log in to Alist. Prefer --alist-password-file or XIAOYA_EMBY_ALIST_PASSWORD to keep it off the command line.")
+	flags.StringVar(&cfg.AlistPasswordFile, "alist-password-file", "", "A file contains the password to log in to Alist.")
+	flags.StringVar(&cfg.AlistToken, "alist-token", "", "Static token of Alist, renewed by logging in if rejected and username is set.")
+	flags.StringVar(&cfg.AlistTokenFile, "alist-token-file", "", "A file contains the static token of Alist.")
+	flags.StringToStringVar(&cfg.AlistPathPassword, "alist-path-password", nil, "Password of protected Alist folders by path, the longest matching path wins. For example: \"/分享/加密=secret\".")
+	flags.StringVar(&cfg.AlistPathPasswordFile, "alist-path-password-file", "", "A file contains passwords of protected Alist folders, one \"path=password\" per line.")
+	flags.StringToStringVar(&cfg.AlistRateLimit, "alist-rate-limit", nil, "Requests per second to Alist by storage provider, as \"rate[:burst]\", slowed down adaptively while Alist fails. \"default\" applies to other providers and to paths whose provider is not known yet, 10 if not set. For example: \"115 Cloud=0.5\".")
+	flags.StringSliceVar(&cfg.AlistPathSkipVerify, "alist-path-skip-verify", nil, "Specify the Alist path to skip verify files. For example: \"/🏷️我的115分享\".")
+	flags.StringVar(&cfg.AlistPathSkipVerifyFromFile, "alist-path-skip-verify-from-file", "", "A file contains a list of Alist path to skip verify.")
+	flags.StringSliceVar(&cfg.StrmPathSkipVerify, "strm-path-skip-verify", nil, "Specify the metadata path to skip verify strm files. For example: \"/115\".")
+	flags.StringVar(&cfg.StrmPathSkipVerifyFromFile, "strm-path-skip-verify-from-file", "", "A file contains a list of strm path to skip verify.")
+}
+
+func (cfg *Config) bindMediaFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&cfg.MediaDir, "media-dir", "d", "/media", "Media directory of Emby to maintain metadata.")
+	flags.StringVarP(&cfg.AlistStrmRootPath, "alist-strm-root-path", "r", defaultAlistStrmRootPath, "Root path of strm files in xiaoya Alist.")
+	flags.BoolVarP(&cfg.Purge, "purge", "p", true, "Whether to purge useless file or directory when media is no longer available.")
+}
+
+func (cfg *Config) bindPurgeFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&cfg.PurgeAfterAbsent, "purge-after-absent", 1, "Purge media of a strm file only after its target is absent on Alist in this many verifications in a row, counting verify-only runs too.")
+	flags.BoolVar(&cfg.PurgeUnknown, "purge-unknown", false, "Also purge media of a strm file whose target is unknown on Alist, e.g. on network errors or rate limiting.")
+}
+
+func (cfg *Config) bindReportFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&cfg.ReportFile, "report-file", "", "Write a JSON report of present, absent and unknown strm files per root directory to this file.")
+}
+
+func (cfg *Config) bindRuntimeFlags(flags *pflag.FlagSet) {
+	flags.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 8*time.Second, "Grace period to finish in-flight tasks on SIGINT or SIGTERM before exiting forcibly.")
+	flags.DurationVar(&cfg.ProgressInterval, "progress-interval", defaultProgressInterval, "Interval to report progress of crawl, verify and sync. Disabled if 0.")
+}
+
+// execute validates options and runs the given stages, then exits on error. On SIGINT or
+// SIGTERM, in-flight tasks are given a grace period to finish.
+func (cfg *Config) execute(stages Stage, daemon bool) {
+	cfg.RunAsDaemon = daemon
+	ecode, err := cfg.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(ecode)
+	}
+	if stages&(StagePurge|StageSync) != 0 && cfg.Purge {
+		// Files to purge are decided by verifying strm targets on Alist.
+		stages |= StageVerify
+	}
+
+	unlock, err := cfg.lockDirs(stages)
+	if err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(ExitCodeLocked)
+	}
+	defer unlock()
+
+	ecodeCh := make(chan int, 1)
+	defer close(ecodeCh)
+
+	errCh := make(chan error, 1)
+	defer close(errCh)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go cfg.Run(ctx, stages, ecodeCh, errCh)
+
+	select {
+	case ecode = <-ecodeCh:
+	case <-ctx.Done():
+		// Restore default behavior, so that a second signal exits immediately.
+		stop()
+		slog.Info("Shutting down, waiting for in-flight tasks", "timeout", cfg.ShutdownTimeout)
+		select {
+		case ecode = <-ecodeCh:
+		case <-time.After(cfg.ShutdownTimeout):
+			fmt.Fprintln(os.Stdout, "shutdown timed out")
+			os.Exit(ExitCodeShutdownTimeout)
+		}
+	}
+	err = <-errCh
+	if err != nil {
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(ecode)
+	}
+}
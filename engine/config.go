@@ -4,20 +4,19 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	cron "github.com/robfig/cron/v3"
-	"github.com/spf13/cobra"
 )
 
 const (
@@ -27,6 +26,7 @@ const (
 )
 
 type Config struct {
+	ConfigFile                  string
 	RunMode                     int
 	RunAsDaemon                 bool
 	RunCron                     string
@@ -34,139 +34,325 @@ type Config struct {
 	DownloadDir                 string
 	Cleanup                     bool
 	Purge                       bool
+	PurgeAfterAbsent            int
+	PurgeUnknown                bool
 	Help                        bool
 	MirrorURL                   []string
 	AlistURL                    string
+	AlistUsername               string
+	AlistPassword               string
+	AlistPasswordFile           string
+	AlistToken                  string
+	AlistTokenFile              string
+	AlistPathPassword           map[string]string
+	AlistPathPasswordFile       string
+	AlistRateLimit              map[string]string
 	AlistStrmRootPath           string
 	AlistPathSkipVerify         []string
 	AlistPathSkipVerifyFromFile string
 	StrmPathSkipVerify          []string
 	StrmPathSkipVerifyFromFile  string
-
+	ReportFile                  string
+	ShutdownTimeout             time.Duration
+	RetryPolicies               map[Stage]*RetryPolicy
+	RetryJitter                 float64
+	Listen                      string
+	CronTimezone                string
+	CronJitter                  time.Duration
+	StartupRun                  string
+	DownloadCron                string
+	VerifyCron                  string
+	SyncCron                    string
+	SyncAfter                   []string
+	LogLevel                    string
+	LogFormat                   string
+	LogFile                     string
+	LogMaxSize                  int
+	LogMaxBackups               int
+	ProgressInterval            time.Duration
+	NotifyOn                    string
+	NotifyPurgeThreshold        int
+	NotifyWebhookURL            string
+	NotifyNtfyURL               string
+	NotifyNtfyToken             string
+	NotifyGotifyURL             string
+	NotifyGotifyToken           string
+	NotifySMTPAddr              string
+	NotifySMTPUsername          string
+	NotifySMTPPassword          string
+	NotifySMTPFrom              string
+	NotifySMTPTo                []string
+	APIToken                    string
+	MediaRefreshThreshold       int
+	EmbyURL                     string
+	EmbyAPIKey                  string
+	EmbyPathMap                 []string
+	EmbyReconcile               string
+	JellyfinURL                 string
+	JellyfinAPIKey              string
+	JellyfinPathMap             []string
+	PlexURL                     string
+	PlexToken                   string
+	PlexPathMap                 []string
+
+	mux         sync.Mutex
 	alistClient *AlistClient
+	daemon      *daemon
+	running     atomic.Bool
+
+	// current is the running run, and stage and progress are of its running stage.
+	current  atomic.Pointer[RunRecord]
+	stage    atomic.Int64
+	progress atomic.Pointer[progress]
+	lastRun  atomic.Pointer[RunRecord]
+
+	// alistRateLimits are parsed from AlistRateLimit.
+	alistRateLimits map[string]*RateLimit
 }
 
-func (cfg *Config) Run(ecodeCh chan<- int, errCh chan<- error) {
+// Run runs the given stages until ctx is canceled, or just once if not running as daemon.
+func (cfg *Config) Run(ctx context.Context, stages Stage, ecodeCh chan<- int, errCh chan<- error) {
 	if cfg.alistClient == nil {
 		cfg.alistClient, _ = NewAlistClient(cfg.AlistURL)
+		cfg.alistClient.Username = cfg.AlistUsername
+		cfg.alistClient.Password = cfg.AlistPassword
+		cfg.alistClient.Token = cfg.AlistToken
+		cfg.alistClient.Passwords = cfg.AlistPathPassword
+		cfg.alistClient.RateLimits = cfg.alistRateLimits
+	}
+
+	if cfg.RunAsDaemon {
+		if err := cfg.runDaemon(ctx, stages); err != nil {
+			cfg.notifyCritical(ctx, err)
+			ecodeCh <- ExitCodeInvalidOptions
+			errCh <- err
+			return
+		}
+		slog.Info("Stopped gracefully")
+		ecodeCh <- ExitCodeOK
+		errCh <- nil
+		return
+	}
+
+	cfg.running.Store(true)
+	err := cfg.runStages(ctx, stages)
+	cfg.running.Store(false)
+	if ctx.Err() != nil {
+		slog.Info("Stopped gracefully")
+		ecodeCh <- ExitCodeOK
+		errCh <- nil
+		return
+	}
+	if err != nil {
+		ecode := ExitCodeInvalidOptions
+		var serr *StageError
+		if errors.As(err, &serr) {
+			ecode = serr.ExitCode()
+		}
+		ecodeCh <- ecode
+		errCh <- err
+		return
+	}
+	ecodeCh <- ExitCodeOK
+	errCh <- nil
+}
+
+// runStages runs the given stages of the pipeline once.
+func (cfg *Config) runStages(ctx context.Context, stages Stage) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
+	rec := newRunRecord(stages)
+	ctx = withRunID(ctx, rec.RunID)
+	cfg.current.Store(rec)
+	defer func() {
+		rec.finish(err)
+		cfg.stage.Store(0)
+		cfg.progress.Store(nil)
+		cfg.refreshMediaServers(ctx, rec)
+		if purgeDone(ctx, stages, err) {
+			cfg.reconcileEmby(ctx, stages, rec)
+		}
+		// rec is published once it is no longer written, as status is read concurrently.
+		cfg.current.Store(nil)
+		cfg.lastRun.Store(rec)
+		observeRun(rec)
+		if err := cfg.saveRun(rec); err != nil {
+			slog.ErrorContext(ctx, "Failed to save run history", "error", err)
+		}
+		cfg.notifyRun(ctx, rec)
+	}()
+	return cfg.runPipeline(ctx, stages, rec)
+}
+
+// purgeDone reports whether the purge stage of stages ran to the end in a run that
+// returned err, and the run was not canceled.
+func purgeDone(ctx context.Context, stages Stage, err error) bool {
+	if !stages.Has(StagePurge) || ctx.Err() != nil {
+		return false
+	}
+	var serr *StageError
+	return err == nil || errors.As(err, &serr) && serr.Stage == StageSync
+}
+
+// runPipeline runs the given stages, and records the outcome in rec.
+func (cfg *Config) runPipeline(ctx context.Context, stages Stage, rec *RunRecord) error {
 	var (
 		remote []*MetadataFile
 		err    error
 	)
 
-	if cfg.RunAsDaemon {
-		log.Println("[INFO] Run as daemon in foreground...")
-	}
-
-METADATA:
-	if cfg.RunMode&4 == 4 {
-		remote, err = cfg.downloadMetadata()
-		if err != nil {
-			if cfg.RunAsDaemon {
-				log.Printf("[ERROR] Critical error: %v", err)
-				time.Sleep(time.Second * 5)
-				goto METADATA
-			}
-			ecodeCh <- 2
-			errCh <- err
+	dctx := withStage(ctx, StageDownload)
+	if stages.Has(StageDownload) {
+		start := time.Now()
+		err = cfg.try(dctx, StageDownload, func() (err error) {
+			remote, err = cfg.downloadMetadata(dctx, rec)
 			return
+		})
+		rec.track(StageDownload, start)
+		if err != nil {
+			return &StageError{Stage: StageDownload, Err: err}
 		}
-		log.Println("[INFO] Finished metadata download.")
+		slog.InfoContext(dctx, "Finished metadata download")
 	} else {
+		// Downloaded metadata is loaded as is, so a failure is of the first stage to run,
+		// and not worth retrying.
 		crawler := &MetadataCrawler{downloadDir: cfg.DownloadDir}
-		remote, err = crawler.LocalFiles()
+		if stages&(StagePurge|StageSync) == 0 {
+			// Verify only, downloaded metadata must be left untouched.
+			remote, err = crawler.LocalFilesReadOnly()
+		} else {
+			remote, err = crawler.LocalFiles()
+		}
 		if err != nil {
-			if cfg.RunAsDaemon {
-				log.Printf("[ERROR] Critical error: %v", err)
-				time.Sleep(time.Second * 5)
-				goto METADATA
-			}
-			ecodeCh <- 2
-			errCh <- err
-			return
+			return &StageError{Stage: stages.first(), Err: fmt.Errorf("load downloaded metadata: %w", err)}
 		}
-		log.Println("[INFO] Skipped metadata download.")
+		slog.InfoContext(dctx, "Skipped metadata download")
 	}
 
-	if cfg.RunMode&1 != 1 {
-		ecodeCh <- 0
-		errCh <- nil
-		return
+	if stages&(StageVerify|StagePurge|StageSync) == 0 {
+		return nil
 	}
 
-COMPARE:
-	filesToPreserve, err := cfg.compareMetadata(remote)
-	if err != nil {
-		if cfg.RunAsDaemon {
-			log.Printf("[ERROR] Critical error: %v", err)
-			time.Sleep(time.Second * 5)
-			goto COMPARE
+	var (
+		filesToPreserve map[string]bool
+		strmToPurge     map[string]bool
+		report          *VerifyReport
+		last            map[string]*verdictRecord
+	)
+	vctx := withStage(ctx, StageVerify)
+	start := time.Now()
+	err = cfg.try(vctx, StageVerify, func() (err error) {
+		if stages.Has(StageVerify) || stages.Has(StagePurge) && cfg.Purge {
+			// Absent streaks go on from the last verification, or purge is decided by
+			// it without verifying on Alist.
+			if last, err = cfg.loadVerdicts(); err != nil {
+				return
+			}
 		}
-		ecodeCh <- 126
-		errCh <- err
+		filesToPreserve, strmToPurge, report, err = cfg.compareMetadata(vctx, remote, stages.Has(StageVerify), last, rec)
 		return
+	})
+	if stages.Has(StageVerify) {
+		rec.track(StageVerify, start)
 	}
-	log.Printf("[INFO] %d metadata files to sync.", len(filesToPreserve))
-
-PREPARE:
-	filesNeedUpdate, err := cfg.prepareMetadataUpdate(filesToPreserve)
 	if err != nil {
-		if cfg.RunAsDaemon {
-			log.Printf("[ERROR] Critical error: %v", err)
-			time.Sleep(time.Second * 5)
-			goto PREPARE
+		return &StageError{Stage: StageVerify, Err: err}
+	}
+	if report != nil {
+		if err = cfg.saveVerdicts(report); err != nil {
+			return &StageError{Stage: StageVerify, Err: err}
 		}
-		ecodeCh <- 127
-		errCh <- err
-		return
 	}
-	log.Printf("[INFO] %d files need to be updated.", len(filesNeedUpdate))
+	if report != nil && cfg.ReportFile != "" {
+		if err = report.WriteFile(cfg.ReportFile); err != nil {
+			return &StageError{Stage: StageVerify, Err: err}
+		}
+		slog.InfoContext(vctx, "Verify report is written", "path", cfg.ReportFile)
+	}
+	if stages&(StagePurge|StageSync) == 0 {
+		return nil
+	}
+	slog.InfoContext(vctx, "Metadata files to sync", "count", len(filesToPreserve))
 
-SYNC:
-	err = cfg.syncMetadata(filesNeedUpdate)
+	verdicts := make(map[string]string, len(last))
+	for path, r := range last {
+		verdicts[path] = r.Verdict
+	}
+	if report != nil {
+		verdicts = report.verdicts
+	}
+	var filesNeedUpdate map[string]fileChange
+	pctx := withStage(ctx, StagePurge)
+	start = time.Now()
+	err = cfg.try(pctx, StagePurge, func() (err error) {
+		filesNeedUpdate, err = cfg.prepareMetadataUpdate(pctx, filesToPreserve, strmToPurge, verdicts, stages.Has(StagePurge), rec)
+		return
+	})
+	if stages.Has(StagePurge) {
+		rec.track(StagePurge, start)
+	}
 	if err != nil {
-		if cfg.RunAsDaemon {
-			log.Printf("[ERROR] Critical error: %v", err)
-			time.Sleep(time.Second * 5)
-			goto SYNC
-		}
-		ecodeCh <- 128
-		errCh <- err
+		return &StageError{Stage: StagePurge, Err: err}
 	}
+	slog.InfoContext(pctx, "Files need to be updated", "count", len(filesNeedUpdate))
 
-	if cfg.RunAsDaemon {
-		sche, _ := cron.ParseStandard(cfg.RunCron)
-		next := sche.Next(time.Now())
-		d := time.Until(next)
-		log.Printf("[INFO] Next task will be started at: %s. Waiting for %v...", next.Format(time.RFC3339), d)
-		time.Sleep(d)
-		goto METADATA
-	}
-	ecodeCh <- 0
-	errCh <- nil
+	if !stages.Has(StageSync) {
+		return nil
+	}
+
+	sctx := withStage(ctx, StageSync)
+	start = time.Now()
+	err = cfg.try(sctx, StageSync, func() error {
+		return cfg.syncMetadata(sctx, filesNeedUpdate, rec)
+	})
+	rec.track(StageSync, start)
+	if err != nil {
+		return &StageError{Stage: StageSync, Err: err}
+	}
+	return nil
 }
 
-func (cfg *Config) downloadMetadata() ([]*MetadataFile, error) {
-	log.Println("[INFO] Start metadata download...")
-	crawler, err := NewMetadataCrawler(cfg.DownloadDir, cfg.MirrorURL, nil, nil, nil, cfg.Cleanup)
+func (cfg *Config) downloadMetadata(ctx context.Context, rec *RunRecord) ([]*MetadataFile, error) {
+	slog.InfoContext(ctx, "Start metadata download")
+	defer func() {
+		if health := lastMirrorHealth.Load(); health != nil {
+			if err := cfg.saveMirrorHealth(*health); err != nil {
+				slog.WarnContext(ctx, "Failed to save mirror health", "error", err)
+			}
+		}
+	}()
+	crawler, err := NewMetadataCrawler(ctx, cfg.DownloadDir, cfg.MirrorURL, nil, nil, nil, cfg.Cleanup)
 	if err != nil {
 		return nil, err
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
+	crawler.progressInterval = cfg.ProgressInterval
+	cfg.progress.Store(crawler.progress)
+	defer func() {
+		downloaded, skipped, failed := crawler.Stats()
+		rec.Downloaded += downloaded
+		rec.Skipped += skipped
+		rec.Failed = failed
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go crawler.Run(ctx)
 
-	if err = crawler.Sync(); err != nil {
+	if err = crawler.Sync(ctx); err != nil {
 		return nil, err
 	}
 
 	return crawler.LocalFiles()
 }
 
-func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, error) {
+// compareMetadata returns metadata files to preserve, and strm files to purge. If verify
+// is true, strm files are verified on Alist and the verification result is reported,
+// otherwise last verdicts are taken. Strm files are purged once absent for
+// cfg.PurgeAfterAbsent verifications in a row, and strm files of unknown verdicts are
+// preserved unless cfg.PurgeUnknown is set.
+func (cfg *Config) compareMetadata(ctx context.Context, files []*MetadataFile, verify bool, last map[string]*verdictRecord, rec *RunRecord) (map[string]bool, map[string]bool, *VerifyReport, error) {
 	strmMap := make(map[string]map[string]bool)
 	fullMap := make(map[string]map[string]bool)
 	for _, file := range files {
@@ -199,10 +385,11 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 	rootDirMap := make(map[string]int)
 	strmToSkip := make(map[string]bool)
 	alistToScan := make(map[string]map[string]string)
+	report := newVerifyReport()
 	workerChan := make(chan struct{}, defaultWorkers())
 
 	for path, strmsMap := range strmMap {
-		if !cfg.Purge {
+		if !verify {
 			rootDirMap[getRootDir(path, cfg.MediaDir)]++
 			validDirs++
 		}
@@ -210,9 +397,11 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 	LOOP:
 		for strm := range strmsMap {
 			fpath := filepath.Join(path, strm)
+			report.strms[fpath] = true
 
 			for _, toSkip := range cfg.StrmPathSkipVerify {
 				if strings.HasPrefix(fpath, toSkip) {
+					report.skipped(fpath)
 					continue LOOP
 				}
 			}
@@ -222,7 +411,7 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 				if os.IsNotExist(err) {
 					continue
 				}
-				return nil, err
+				return nil, nil, nil, err
 			}
 
 			s := strings.ReplaceAll(string(bytes.TrimSpace(p)), "%20", " ")
@@ -236,6 +425,7 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 
 				for _, toSkip := range cfg.AlistPathSkipVerify {
 					if strings.HasPrefix(relUrl, toSkip) {
+						report.skipped(fpath)
 						continue LOOP
 					}
 				}
@@ -248,11 +438,19 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 				}
 				alistfiles[alistfile] = fpath
 				alistToScan[alistdir] = alistfiles
+				continue
 			}
+			report.skipped(fpath)
 		}
 	}
 
-	if cfg.Purge {
+	if verify {
+		prog := newProgress("verify", "verified")
+		cfg.progress.Store(prog)
+		prog.queued.Add(int64(len(alistToScan)))
+		prog.queuedAll()
+		stop := prog.report(ctx, cfg.ProgressInterval)
+
 		fdirMap := make(map[string]int)
 		for alistdir, alistfiles := range alistToScan {
 			wg.Add(1)
@@ -262,24 +460,32 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 				workerChan <- struct{}{}
 				defer func() { <-workerChan }()
 
-				files, err := cfg.alistClient.ReadDir(alistpath)
+				files, err := cfg.alistClient.ReadDir(ctx, alistpath)
 				if err != nil {
+					prog.failed.Add(1)
 					mux.Lock()
 					defer mux.Unlock()
 
+					// Only a folder surely not found is absent.
+					notFound := errors.Is(err, ErrNotFound)
 					for _, fpath := range alistfiles {
-						strmToSkip[fpath] = true
+						if notFound {
+							report.absent(fpath)
+						} else {
+							report.unknown(fpath)
+						}
 					}
 
-					if os.IsNotExist(err) {
-						log.Printf("[WARN] Absent stream folder [%s] on Alist.", alistpath)
+					if notFound {
+						slog.WarnContext(ctx, "Absent stream folder on Alist", "path", alistpath)
 						return
 					}
 
-					log.Printf("[ERROR] Cannot verify stream folder [%s] on Alist: %v", alistpath, err)
+					slog.ErrorContext(ctx, "Cannot verify stream folder on Alist", "path", alistpath, "error", err)
 					return
 				}
 
+				prog.done.Add(1)
 				mux.Lock()
 				defer mux.Unlock()
 
@@ -292,15 +498,21 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 				for alistfile, fpath := range alistfiles {
 					if m[alistfile] {
 						fdirMap[filepath.Dir(fpath)]++
+						report.present(fpath)
 						continue
 					}
-					strmToSkip[fpath] = true
-					log.Printf("[WARN] Absent stream [%s] on Alist.", filepath.Join(alistpath, alistfile))
+					report.absent(fpath)
+					slog.WarnContext(ctx, "Absent stream on Alist", "path", filepath.Join(alistpath, alistfile))
 				}
 			}(alistdir, alistfiles)
 		}
 
 		wg.Wait()
+		stop()
+		// Folders failed to verify due to cancellation must not be purged.
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
 
 		for fpath := range fdirMap {
 			rootDirMap[getRootDir(fpath, cfg.MediaDir)]++
@@ -308,6 +520,29 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 		}
 	}
 
+	verdicts := last
+	if verify {
+		verdicts = make(map[string]*verdictRecord, len(report.verdicts))
+		for fpath, verdict := range report.verdicts {
+			streak := absentStreak(last[fpath], verdict)
+			report.streaks[fpath] = streak
+			verdicts[fpath] = &verdictRecord{Verdict: verdict, VerifiedAt: report.Time, AbsentStreak: streak}
+		}
+	}
+	pending := 0
+	for fpath, r := range verdicts {
+		switch {
+		case r.Verdict == VerdictAbsent && r.AbsentStreak >= cfg.PurgeAfterAbsent,
+			r.Verdict == VerdictUnknown && cfg.PurgeUnknown:
+			strmToSkip[fpath] = true
+		case r.Verdict == VerdictAbsent:
+			pending++
+		}
+	}
+	if pending > 0 {
+		slog.InfoContext(ctx, "Absent strm files are kept until confirmed", "count", pending, "purge_after_absent", cfg.PurgeAfterAbsent)
+	}
+
 	filesToPreserve := make(map[string]bool)
 	for dir, files := range fullMap {
 		for file := range files {
@@ -320,19 +555,48 @@ func (cfg *Config) compareMetadata(files []*MetadataFile) (map[string]bool, erro
 		}
 	}
 
-	p, err := json.MarshalIndent(rootDirMap, "", "  ")
-	if err == nil {
-		log.Printf("[INFO] Valid metadata directories =>\n%s\n", p)
+	slog.InfoContext(ctx, "Valid metadata directories", "roots", rootDirMap, "valid", validDirs, "total", len(strmMap))
+	rec.ValidDirs = rootDirMap
+	if !verify {
+		return filesToPreserve, strmToSkip, nil, nil
 	}
-	log.Printf("[INFO] %d/%d valid metadata directories in total.\n", validDirs, len(strmMap))
-	return filesToPreserve, nil
+
+	slog.InfoContext(ctx, "Verified strm files", "roots", report.summary())
+	return filesToPreserve, strmToSkip, report, nil
 }
 
-func (cfg *Config) prepareMetadataUpdate(filesToPreserve map[string]bool) (map[string]bool, error) {
+// prepareMetadataUpdate returns metadata files that need to be synced to media directory.
+// If purge is true, files not to preserve and strmToPurge are removed from media
+// directory, and the reasons of strm files are told by their verdicts.
+func (cfg *Config) prepareMetadataUpdate(ctx context.Context, filesToPreserve, strmToPurge map[string]bool, verdicts map[string]string, purge bool, rec *RunRecord) (map[string]fileChange, error) {
 	if err := os.MkdirAll(cfg.MediaDir, dirPerm); err != nil {
 		return nil, err
 	}
 
+	if purge {
+		// Strm files are not recorded in media directory, so they are removed by path.
+		for strm := range strmToPurge {
+			target := filepath.Join(cfg.MediaDir, strm)
+			info, err := os.Stat(target)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Remove(target); err != nil {
+				return nil, err
+			}
+			oldSize := info.Size()
+			reason := removalReason(strm, verdicts)
+			rec.Purged++
+			rec.change(&Change{Path: strm, Action: ChangeRemoved, OldSize: &oldSize, Reason: reason})
+			slog.InfoContext(ctx, "Purged strm file", "path", strm, "reason", reason)
+			metricFilesPurged.WithLabelValues(rootLabel(strm)).Inc()
+			deleteDirIfEmpty(filepath.Dir(target))
+		}
+	}
+
 	localDB, err := sql.Open("sqlite3", filepath.Join(cfg.MediaDir, ".metadata.db"))
 	if err != nil {
 		return nil, err
@@ -343,29 +607,35 @@ func (cfg *Config) prepareMetadataUpdate(filesToPreserve map[string]bool) (map[s
 		return nil, err
 	}
 
-	rows, err := localDB.Query("SELECT path, name, size, modified, etag FROM files")
+	local, err := listFiles(localDB)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	localMap := make(map[string]*MetadataFile)
-	for rows.Next() {
-		f := &MetadataFile{}
-		if err := rows.Scan(&f.path, &f.name, &f.size, &f.modified, &f.etag); err != nil {
-			return nil, err
-		}
+	for _, f := range local {
 		localMap[f.Path()] = f
 
-		if ok := filesToPreserve[f.Path()]; !ok {
-			tx, err := localDB.Begin()
+		if ok := filesToPreserve[f.Path()]; !ok && purge {
+			tx, err := localDB.BeginTx(ctx, nil)
 			if err != nil {
 				return nil, err
 			}
-			defer tx.Rollback()
 
-			deleteFile(tx, f)
-			deleteDirIfEmpty(filepath.Dir(f.Path()))
+			if err := deleteFile(tx, cfg.MediaDir, f); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			rec.Purged++
+			rec.change(&Change{
+				Path:    f.Path(),
+				Action:  ChangeRemoved,
+				OldSize: &f.size,
+				OldETag: f.ETag(),
+				Reason:  reasonNoLongerOnMirror,
+			})
+			metricFilesPurged.WithLabelValues(rootLabel(f.Path())).Inc()
+			deleteDirIfEmpty(filepath.Join(cfg.MediaDir, filepath.Dir(f.Path())))
 		}
 	}
 
@@ -375,7 +645,7 @@ func (cfg *Config) prepareMetadataUpdate(filesToPreserve map[string]bool) (map[s
 	}
 	defer remoteDB.Close()
 
-	filesNeedUpdate := make(map[string]bool)
+	filesNeedUpdate := make(map[string]fileChange)
 	for path := range filesToPreserve {
 		remoteFile, err := pickFirstFile(remoteDB, path)
 		if err != nil {
@@ -386,14 +656,30 @@ func (cfg *Config) prepareMetadataUpdate(filesToPreserve map[string]bool) (map[s
 		}
 
 		localFile, ok := localMap[path]
-		if filepath.Ext(remoteFile.Name()) == ".strm" || !ok || (remoteFile.ModTime().Sub(localFile.ModTime()) > 0 && (remoteFile.Size() != localFile.Size() || remoteFile.ETag() != localFile.ETag())) {
-			filesNeedUpdate[remoteFile.Path()] = true
+		switch {
+		case !ok:
+			filesNeedUpdate[remoteFile.Path()] = changeAdded
+		case remoteFile.ModTime().Sub(localFile.ModTime()) > 0 && (remoteFile.Size() != localFile.Size() || remoteFile.ETag() != localFile.ETag()):
+			filesNeedUpdate[remoteFile.Path()] = changeUpdated
+		case filepath.Ext(remoteFile.Name()) == ".strm":
+			// Always rewritten, as Alist url may have changed.
+			filesNeedUpdate[remoteFile.Path()] = changeNone
 		}
 	}
 	return filesNeedUpdate, nil
 }
 
-func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
+// fileChange is how a metadata file changes in media directory when synced.
+type fileChange int
+
+const (
+	// changeNone is a file rewritten without change, e.g. a strm file.
+	changeNone fileChange = iota
+	changeAdded
+	changeUpdated
+)
+
+func (cfg *Config) syncMetadata(ctx context.Context, filesToUpdate map[string]fileChange, rec *RunRecord) error {
 	strmList, otherList := make(map[string]bool), make(map[string]bool)
 	for fpath := range filesToUpdate {
 		fname := filepath.Base(fpath)
@@ -405,7 +691,12 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 		}
 	}
 
-	log.Println("[INFO] Finalizing updates...")
+	slog.InfoContext(ctx, "Finalizing updates", "count", len(filesToUpdate))
+	prog := newProgress("sync", "synced")
+	cfg.progress.Store(prog)
+	prog.queued.Add(int64(len(filesToUpdate)))
+	prog.queuedAll()
+	defer prog.report(ctx, cfg.ProgressInterval)()
 
 	o, err := url.Parse(cfg.AlistURL)
 	if err != nil {
@@ -413,6 +704,10 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 	}
 
 	for strm := range strmList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		fpath := filepath.Join(cfg.DownloadDir, strm)
 		dir := filepath.Dir(fpath)
 		if err := os.MkdirAll(dir, dirPerm); err != nil {
@@ -443,9 +738,23 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 		if err := os.MkdirAll(filepath.Dir(target), dirPerm); err != nil {
 			return err
 		}
-		if err := os.WriteFile(target, []byte(s+"\n"), filePerm); err != nil {
+		// Strm files are not recorded in media directory, so they are compared by content.
+		newSize := int64(len(s) + 1)
+		change := &Change{Path: strm, Action: ChangeAdded, NewSize: &newSize, Reason: reasonNewOnMirror}
+		if old, err := os.ReadFile(target); err == nil {
+			oldSize := int64(len(old))
+			change.Action, change.OldSize, change.Reason = ChangeUpdated, &oldSize, reasonStrmURLChanged
+			if string(old) == s+"\n" {
+				change.Action = ""
+			}
+		}
+		if err := writeFileAtomic(target, strings.NewReader(s+"\n")); err != nil {
 			return err
 		}
+		prog.done.Add(1)
+		prog.bytes.Add(newSize)
+		rec.change(change)
+		metricFilesSynced.WithLabelValues(rootLabel(strm)).Inc()
 	}
 
 	localDB, err := sql.Open("sqlite3", filepath.Join(cfg.MediaDir, ".metadata.db"))
@@ -461,6 +770,10 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 	defer remoteDB.Close()
 
 	for file := range otherList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		fpath := filepath.Join(cfg.DownloadDir, file)
 		dir := filepath.Dir(fpath)
 		if err := os.MkdirAll(dir, dirPerm); err != nil {
@@ -475,7 +788,23 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 			continue
 		}
 
-		tx, err := localDB.Begin()
+		change := &Change{Path: file, NewSize: &remoteFile.size, NewETag: remoteFile.ETag()}
+		switch filesToUpdate[file] {
+		case changeAdded:
+			change.Action, change.Reason = ChangeAdded, reasonNewOnMirror
+		case changeUpdated:
+			change.Action, change.Reason = ChangeUpdated, reasonNewerOnMirror
+			localFile, err := pickFirstFile(localDB, file)
+			if err != nil {
+				return err
+			}
+			if localFile != nil {
+				change.OldSize, change.OldETag = &localFile.size, localFile.ETag()
+			}
+		}
+
+		// Copy in progress should be committed even if ctx is canceled.
+		tx, err := localDB.BeginTx(context.WithoutCancel(ctx), nil)
 		if err != nil {
 			return err
 		}
@@ -485,59 +814,15 @@ func (cfg *Config) syncMetadata(filesToUpdate map[string]bool) error {
 			return err
 		}
 		tx.Rollback()
+		prog.done.Add(1)
+		prog.bytes.Add(remoteFile.Size())
+		rec.change(change)
+		metricFilesSynced.WithLabelValues(rootLabel(file)).Inc()
 	}
-	log.Println("[INFO] Done.")
+	slog.InfoContext(ctx, "Done")
 	return nil
 }
 
-func (cfg *Config) Command() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:     "xiaoya-emby",
-		Short:   "Xiaoya utility for Emby",
-		Long:    `Utility to maintain metadata files in xiaoya media library for Emby`,
-		Version: Version,
-		Run: func(cmd *cobra.Command, args []string) {
-			ecode, err := cfg.Validate()
-			if err != nil {
-				fmt.Fprintln(os.Stdout, err)
-				os.Exit(ecode)
-			}
-
-			ecodeCh := make(chan int, 1)
-			defer close(ecodeCh)
-
-			errCh := make(chan error, 1)
-			defer close(errCh)
-
-			go cfg.Run(ecodeCh, errCh)
-
-			ecode, err = <-ecodeCh, <-errCh
-			if err != nil {
-				fmt.Fprintln(os.Stdout, err)
-				os.Exit(ecode)
-			}
-		},
-	}
-	var version bool
-	cmd.Flags().IntVar(&cfg.RunMode, "mode", 7, "Run mode (4: scan metadata, 2: preserved bit, 1: sync metadata)")
-	cmd.Flags().BoolVar(&cfg.RunAsDaemon, "daemon", true, "Run as daemon in foreground.")
-	cmd.Flags().StringVar(&cfg.RunCron, "cron-expr", "0 0 * * *", "Cron expression as scheduled task. Must run as daemon.")
-	cmd.Flags().StringVarP(&cfg.MediaDir, "media-dir", "d", "/media", "Media directory of Emby to maintain metadata.")
-	cmd.Flags().StringVarP(&cfg.DownloadDir, "download-dir", "D", "/download", "Media directory of Emby to download metadata to.")
-	cmd.Flags().BoolVar(&cfg.Cleanup, "cleanup", false, "Cleanup downloaded metadata when file no longer exists on remote server.")
-	cmd.Flags().BoolVarP(&cfg.Purge, "purge", "p", true, "Whether to purge useless file or directory when media is no longer available.")
-	cmd.Flags().BoolVarP(&cfg.Help, "help", "h", false, "Print this message.")
-	cmd.Flags().BoolVarP(&version, "version", "v", false, "Print software version.")
-	cmd.Flags().StringSliceVarP(&cfg.MirrorURL, "mirror-url", "m", nil, "Specify the mirror URL to sync metadata from.")
-	cmd.Flags().StringVarP(&cfg.AlistURL, "alist-url", "u", defaultAlistEndpoint, "Endpoint of xiaoya Alist. Change this value will result to url overide in strm file.")
-	cmd.Flags().StringVarP(&cfg.AlistStrmRootPath, "alist-strm-root-path", "r", defaultAlistStrmRootPath, "Root path of strm files in xiaoya Alist.")
-	cmd.Flags().StringSliceVar(&cfg.AlistPathSkipVerify, "alist-path-skip-verify", nil, "Specify the Alist path to skip verify files. For example: \"/🏷️我的115分享\".")
-	cmd.Flags().StringVar(&cfg.AlistPathSkipVerifyFromFile, "alist-path-skip-verify-from-file", "", "A file contains a list of Alist path to skip verify.")
-	cmd.Flags().StringSliceVar(&cfg.StrmPathSkipVerify, "strm-path-skip-verify", nil, "Specify the metadata path to skip verify strm files. For example: \"/115\".")
-	cmd.Flags().StringVar(&cfg.StrmPathSkipVerifyFromFile, "strm-path-skip-verify-from-file", "", "A file contains a list of strm path to skip verify.")
-	return cmd
-}
-
 func (cfg *Config) Validate() (int, error) {
 	cfg.AlistURL = strings.TrimSuffix(cfg.AlistURL, "/") + "/"
 
@@ -549,9 +834,109 @@ func (cfg *Config) Validate() (int, error) {
 		return 2, fmt.Errorf("alist url must be root path: %s", cfg.AlistURL)
 	}
 
-	_, err = cron.ParseStandard(cfg.RunCron)
-	if err != nil {
-		return 2, fmt.Errorf("invalid cron expression: %s", cfg.RunCron)
+	if cfg.RunAsDaemon {
+		_, err = cron.ParseStandard(cfg.RunCron)
+		if err != nil {
+			return 2, fmt.Errorf("invalid cron expression: %s", cfg.RunCron)
+		}
+		if _, err = cfg.cronLocation(); err != nil {
+			return 2, fmt.Errorf("invalid cron timezone: %s", cfg.CronTimezone)
+		}
+		if cfg.CronJitter < 0 {
+			return 2, fmt.Errorf("cron jitter must not be negative: %v", cfg.CronJitter)
+		}
+		switch cfg.StartupRun {
+		case StartupRunAlways, StartupRunMissed, StartupRunNever:
+		default:
+			return 2, fmt.Errorf("invalid startup run policy: %s", cfg.StartupRun)
+		}
+		for _, spec := range []string{cfg.DownloadCron, cfg.VerifyCron, cfg.SyncCron} {
+			if spec == "" || spec == CronOff {
+				continue
+			}
+			if _, err = cron.ParseStandard(spec); err != nil {
+				return 2, fmt.Errorf("invalid cron expression: %s", spec)
+			}
+		}
+		for _, name := range cfg.SyncAfter {
+			if name != scheduleDownload && name != scheduleVerify {
+				return 2, fmt.Errorf("sync can only run after download or verify: %s", name)
+			}
+		}
+	}
+
+	for stage, policy := range cfg.RetryPolicies {
+		if err := policy.validate(stage); err != nil {
+			return 2, err
+		}
+	}
+	if cfg.PurgeAfterAbsent < 0 {
+		return 2, fmt.Errorf("purge after absent must not be negative: %d", cfg.PurgeAfterAbsent)
+	}
+	if cfg.PurgeAfterAbsent == 0 {
+		// Unset by commands that never purge, and purged at the first absence anyway.
+		cfg.PurgeAfterAbsent = 1
+	}
+	if cfg.RetryJitter < 0 || cfg.RetryJitter > 1 {
+		return 2, fmt.Errorf("retry jitter must be between 0 and 1: %v", cfg.RetryJitter)
+	}
+	if err := cfg.validateNotify(); err != nil {
+		return 2, err
+	}
+	if err := cfg.validateMediaServers(); err != nil {
+		return 2, err
+	}
+	if err := cfg.validateReconcile(); err != nil {
+		return 2, err
+	}
+
+	if cfg.AlistPasswordFile != "" {
+		p, err := os.ReadFile(cfg.AlistPasswordFile)
+		if err != nil {
+			return 2, fmt.Errorf("AlistPasswordFile is invalid: %v", err)
+		}
+		cfg.AlistPassword = string(bytes.TrimSpace(p))
+	}
+	if cfg.AlistTokenFile != "" {
+		p, err := os.ReadFile(cfg.AlistTokenFile)
+		if err != nil {
+			return 2, fmt.Errorf("AlistTokenFile is invalid: %v", err)
+		}
+		cfg.AlistToken = string(bytes.TrimSpace(p))
+	}
+	if cfg.AlistUsername != "" && cfg.AlistPassword == "" {
+		return 2, fmt.Errorf("Alist password is required with username")
+	}
+	if cfg.AlistPathPasswordFile != "" {
+		p, err := os.ReadFile(cfg.AlistPathPasswordFile)
+		if err != nil {
+			return 2, fmt.Errorf("AlistPathPasswordFile is invalid: %v", err)
+		}
+		if cfg.AlistPathPassword == nil {
+			cfg.AlistPathPassword = make(map[string]string)
+		}
+		for _, each := range strings.Split(string(bytes.TrimSpace(p)), "\n") {
+			each = strings.TrimSpace(each)
+			if each == "" || strings.HasPrefix(each, "#") {
+				continue
+			}
+			path, password, ok := strings.Cut(each, "=")
+			if !ok {
+				return 2, fmt.Errorf("AlistPathPasswordFile is invalid: expect path=password, got %q", each)
+			}
+			cfg.AlistPathPassword[strings.TrimSpace(path)] = password
+		}
+	}
+	if len(cfg.AlistPathPassword) > 0 {
+		m := make(map[string]string, len(cfg.AlistPathPassword))
+		for path, password := range cfg.AlistPathPassword {
+			path = "/" + strings.Trim(path, "/")
+			m[path] = password
+		}
+		cfg.AlistPathPassword = m
+	}
+	if cfg.alistRateLimits, err = parseRateLimits(cfg.AlistRateLimit); err != nil {
+		return 2, fmt.Errorf("AlistRateLimit is invalid: %v", err)
 	}
 
 	if cfg.AlistPathSkipVerifyFromFile != "" {
@@ -632,20 +1017,13 @@ func copyFile(tx *sql.Tx, file *MetadataFile, to, from string) error {
 		return err
 	}
 
-	toFile, err := os.Create(to)
-	if err != nil {
-		return err
-	}
-	defer toFile.Close()
-
 	fromFile, err := os.Open(from)
 	if err != nil {
 		return err
 	}
 	defer fromFile.Close()
 
-	_, err = io.Copy(toFile, fromFile)
-	if err != nil {
+	if err := writeFileAtomic(to, fromFile); err != nil {
 		return err
 	}
 
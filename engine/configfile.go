@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix = "XIAOYA_EMBY_"
+)
+
+// flagsSkipLoading are flags that can only be set from the command line.
+var flagsSkipLoading = map[string]bool{
+	"config":  true,
+	"help":    true,
+	"version": true,
+}
+
+// loadConfig fills flags of cmd that are not set on the command line. Values are taken
+// from XIAOYA_EMBY_* environment variables first, then from the config file. Keys in the
+// config file are the flag names, with either "-" or "_" as separator. A config file can
+// be shared among subcommands, so options of other subcommands are ignored.
+func (cfg *Config) loadConfig(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	values := make(map[string]any)
+	if cfg.ConfigFile != "" {
+		var err error
+		values, err = readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %v", cfg.ConfigFile, err)
+		}
+	}
+
+	known := make(map[string]bool)
+	collectFlags(cmd.Root(), known)
+
+	var unknown []string
+	for key := range values {
+		if flagsSkipLoading[key] || !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown options in config file %s: %s", cfg.ConfigFile, strings.Join(unknown, ", "))
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || flagsSkipLoading[f.Name] {
+			return
+		}
+		if s, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := f.Value.Set(s); e != nil {
+				err = fmt.Errorf("invalid value of %s: %v", envName(f.Name), e)
+			}
+			return
+		}
+		if v, ok := values[f.Name]; ok {
+			if e := setFlagValue(f, v); e != nil {
+				err = fmt.Errorf("invalid value of %q in config file: %v", f.Name, e)
+			}
+		}
+	})
+	return err
+}
+
+func collectFlags(cmd *cobra.Command, known map[string]bool) {
+	cmd.LocalFlags().VisitAll(func(f *pflag.Flag) {
+		known[f.Name] = true
+	})
+	for _, sub := range cmd.Commands() {
+		collectFlags(sub, known)
+	}
+}
+
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+func readConfigFile(path string) (map[string]any, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(bytes.NewReader(p)).Decode(&raw); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(p, &raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expect .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	values := make(map[string]any, len(raw))
+	for k, v := range raw {
+		values[strings.ReplaceAll(k, "_", "-")] = v
+	}
+	return values, nil
+}
+
+func setFlagValue(f *pflag.Flag, v any) error {
+	switch v := v.(type) {
+	case []any:
+		ss := make([]string, 0, len(v))
+		for _, each := range v {
+			ss = append(ss, fmt.Sprint(each))
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			return sv.Replace(ss)
+		}
+		for _, s := range ss {
+			if err := f.Value.Set(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := f.Value.Set(csvField(k + "=" + fmt.Sprint(v[k]))); err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return nil
+	default:
+		return f.Value.Set(fmt.Sprint(v))
+	}
+}
+
+// csvField quotes s so that flags parsing comma separated values keep it as a single field.
+func csvField(s string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{s})
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,477 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	cron "github.com/robfig/cron/v3"
+	_ "time/tzdata"
+)
+
+// Policies to run a cycle when daemon starts.
+const (
+	StartupRunAlways = "always"
+	StartupRunMissed = "missed"
+	StartupRunNever  = "never"
+)
+
+// CronOff disables the schedule of a stage.
+const CronOff = "off"
+
+// Names of independent schedules.
+const (
+	scheduleDownload = "download"
+	scheduleVerify   = "verify"
+	scheduleSync     = "sync"
+)
+
+// daemon schedules cycles of the pipeline.
+type daemon struct {
+	ctx context.Context
+	cfg *Config
+
+	scheduler *cron.Cron
+	schedules []*schedule
+	// pipeline serializes cycles of all schedules, as they share directories.
+	pipeline sync.Mutex
+	// cycles are waited for on shutdown. Once stopping is set, no cycle is added.
+	cycles   sync.WaitGroup
+	stopping bool
+
+	started atomic.Bool
+	// paused skips scheduled cycles. Cycles run on demand are not affected.
+	paused atomic.Bool
+	// mux guards cancel and stopping.
+	mux sync.Mutex
+	// cancel cancels the running cycle.
+	cancel context.CancelFunc
+}
+
+// schedule runs some stages of the pipeline by a cron expression, or after other
+// schedules succeeded.
+type schedule struct {
+	// name is empty if all stages run in a single schedule.
+	name   string
+	stages Stage
+	spec   string
+
+	entryID cron.EntryID
+	// job runs a cycle, unless the previous one is still running.
+	job cron.Job
+	// next are schedules to run after a successful cycle.
+	next []*schedule
+	// manual is set for cycles run on demand out of schedules, which are not recorded
+	// as scheduled runs.
+	manual bool
+}
+
+func (s *schedule) String() string {
+	if s.name == "" {
+		return "task"
+	}
+	return s.name + " task"
+}
+
+// runDaemon runs cycles as scheduled until ctx is canceled. On cancellation, it waits for
+// the running cycle to stop.
+func (cfg *Config) runDaemon(ctx context.Context, stages Stage) error {
+	slog.Info("Run as daemon in foreground")
+
+	loc, err := cfg.cronLocation()
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{ctx: ctx, cfg: cfg, schedules: cfg.schedules(stages)}
+	logger := cronLogger{}
+	d.scheduler = cron.New(cron.WithLocation(loc), cron.WithLogger(logger))
+	for _, s := range d.schedules {
+		s.job = cron.NewChain(cron.SkipIfStillRunning(logger)).Then(cron.FuncJob(func() {
+			d.runCycle(ctx, s)
+		}))
+		if s.spec == CronOff {
+			continue
+		}
+		s.entryID, err = d.scheduler.AddJob(s.spec, cron.FuncJob(func() {
+			if !d.addCycle() {
+				return
+			}
+			defer d.cycles.Done()
+
+			if cfg.CronJitter > 0 {
+				if sleepContext(ctx, rand.N(cfg.CronJitter)) != nil {
+					return
+				}
+			}
+			if d.paused.Load() {
+				slog.Info("Skipped scheduled task as daemon is paused", "schedule", s.String())
+				d.logNext(s)
+				return
+			}
+			s.job.Run()
+		}))
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.mux.Lock()
+	cfg.daemon = d
+	cfg.mux.Unlock()
+
+	if err := cfg.startTriggers(ctx); err != nil {
+		return err
+	}
+
+	d.scheduler.Start()
+	d.started.Store(true)
+	for _, s := range d.schedules {
+		if ok, reason := d.runOnStartup(s); ok {
+			slog.Info("Run on startup", "schedule", s.String(), "reason", reason)
+			d.run(s)
+		} else {
+			d.logNext(s)
+		}
+	}
+
+	<-ctx.Done()
+	d.mux.Lock()
+	d.stopping = true
+	d.mux.Unlock()
+	<-d.scheduler.Stop().Done()
+	d.cycles.Wait()
+	return nil
+}
+
+// addCycle adds a cycle to wait for on shutdown. It returns false if daemon is stopping,
+// and the cycle must not run.
+func (d *daemon) addCycle() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.stopping {
+		return false
+	}
+	d.cycles.Add(1)
+	return true
+}
+
+// schedules returns schedules of the given stages. All stages run in a single schedule
+// of --cron-expr, unless any stage has its own schedule or dependency.
+func (cfg *Config) schedules(stages Stage) []*schedule {
+	if cfg.DownloadCron == "" && cfg.VerifyCron == "" && cfg.SyncCron == "" && len(cfg.SyncAfter) == 0 {
+		return []*schedule{{stages: stages, spec: cfg.RunCron}}
+	}
+
+	var (
+		schedules []*schedule
+		byName    = make(map[string]*schedule)
+	)
+	for _, each := range []struct {
+		name   string
+		stages Stage
+		spec   string
+	}{
+		{scheduleDownload, stages & StageDownload, cfg.DownloadCron},
+		{scheduleVerify, stages & StageVerify, cfg.VerifyCron},
+		{scheduleSync, stages & (StagePurge | StageSync), cfg.SyncCron},
+	} {
+		if each.stages == 0 {
+			continue
+		}
+		if each.spec == "" {
+			each.spec = cfg.RunCron
+		}
+		s := &schedule{name: each.name, stages: each.stages, spec: each.spec}
+		schedules = append(schedules, s)
+		byName[s.name] = s
+	}
+
+	if sync := byName[scheduleSync]; sync != nil {
+		triggered := false
+		for _, name := range cfg.SyncAfter {
+			if s := byName[name]; s != nil {
+				s.next = append(s.next, sync)
+				triggered = true
+			}
+		}
+		if sync.spec == CronOff && !triggered {
+			slog.Warn("Sync is neither scheduled nor run after other stages, it will never run")
+		}
+	}
+	return schedules
+}
+
+// runCycle runs a cycle of schedule, and records the time if it succeeded. Cycles of
+// other schedules are waited for.
+func (d *daemon) runCycle(ctx context.Context, s *schedule) {
+	d.pipeline.Lock()
+	defer d.pipeline.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.cfg.running.Store(true)
+	defer d.cfg.running.Store(false)
+
+	cycleCtx, cancel := context.WithCancel(ctx)
+	d.mux.Lock()
+	d.cancel = cancel
+	d.mux.Unlock()
+	defer func() {
+		d.mux.Lock()
+		d.cancel = nil
+		d.mux.Unlock()
+		cancel()
+	}()
+
+	start := time.Now()
+	err := d.cfg.runStages(cycleCtx, s.stages)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil && cycleCtx.Err() != nil {
+		slog.Warn("Cycle canceled", "schedule", s.String())
+	} else if err != nil {
+		slog.Error("Cycle failed", "schedule", s.String(), "error", err)
+	} else {
+		if !s.manual {
+			if err := d.cfg.saveLastSuccess(s.name, start); err != nil {
+				slog.Error("Failed to save state", "error", err)
+			}
+		}
+		for _, next := range s.next {
+			slog.Info("Run dependent schedule", "schedule", next.String(), "after", s.String())
+			d.run(next)
+		}
+	}
+	d.logNext(s)
+}
+
+// run runs a cycle of schedule immediately in background.
+func (d *daemon) run(s *schedule) {
+	if d.ctx.Err() != nil || !d.addCycle() {
+		return
+	}
+	go func() {
+		defer d.cycles.Done()
+		s.job.Run()
+	}()
+}
+
+// runNow runs a cycle of the first schedule immediately, which is followed by its
+// dependent schedules.
+func (d *daemon) runNow() {
+	d.run(d.schedules[0])
+}
+
+// runManual runs a cycle of the given stages immediately in background, out of schedules.
+func (d *daemon) runManual(stages Stage) {
+	s := &schedule{name: "manual", stages: stages, manual: true}
+	s.job = cron.FuncJob(func() { d.runCycle(d.ctx, s) })
+	d.run(s)
+}
+
+// stages returns stages of all schedules.
+func (d *daemon) stages() Stage {
+	var stages Stage
+	for _, s := range d.schedules {
+		stages |= s.stages
+	}
+	return stages
+}
+
+// cancelCycle cancels the running cycle. It returns false if no cycle is running.
+func (d *daemon) cancelCycle() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.cancel == nil {
+		return false
+	}
+	d.cancel()
+	return true
+}
+
+// next returns the next scheduled time of s, or zero if it is not scheduled.
+func (d *daemon) next(s *schedule) time.Time {
+	if s.entryID == 0 {
+		return time.Time{}
+	}
+	next := d.scheduler.Entry(s.entryID).Next
+	if next.IsZero() {
+		next = d.scheduler.Entry(s.entryID).Schedule.Next(time.Now())
+	}
+	return next
+}
+
+// runOnStartup reports whether to run a cycle of schedule on startup, and why.
+func (d *daemon) runOnStartup(s *schedule) (bool, string) {
+	if s.spec == CronOff {
+		return false, ""
+	}
+	switch d.cfg.StartupRun {
+	case StartupRunAlways:
+		return true, "always"
+	case StartupRunNever:
+		return false, ""
+	}
+
+	last, err := d.cfg.lastSuccess(s.name)
+	if err != nil {
+		slog.Warn("Failed to load last successful run", "error", err)
+		return true, "unknown last successful run"
+	}
+	if last.IsZero() {
+		return true, "no successful run yet"
+	}
+	next := d.scheduler.Entry(s.entryID).Schedule.Next(last)
+	if !next.After(time.Now()) {
+		return true, fmt.Sprintf("missed scheduled run at %s", next.Format(time.RFC3339))
+	}
+	return false, ""
+}
+
+func (d *daemon) logNext(s *schedule) {
+	next := d.next(s)
+	if next.IsZero() {
+		return
+	}
+	slog.Info("Next task scheduled", "schedule", s.String(), "at", next.Format(time.RFC3339), "wait", time.Until(next).Round(time.Second))
+}
+
+// RunNow starts a cycle of daemon immediately. It returns false if the request is
+// coalesced into a running cycle.
+func (cfg *Config) RunNow() bool {
+	d := cfg.getDaemon()
+	if d == nil || cfg.running.Load() {
+		return false
+	}
+	d.runNow()
+	return true
+}
+
+// RunStages starts a cycle of the given stages of daemon immediately, out of schedules.
+// It returns false if the request is coalesced into a running cycle.
+func (cfg *Config) RunStages(stages Stage) (bool, error) {
+	d := cfg.getDaemon()
+	if d == nil {
+		return false, nil
+	}
+	if !d.stages().Has(stages) {
+		return false, fmt.Errorf("stages are not run by daemon: %s", stages)
+	}
+	if cfg.running.Load() {
+		return false, nil
+	}
+	d.runManual(stages)
+	return true, nil
+}
+
+// parseScheduleStages returns stages of schedules by name, e.g. "download" and "sync".
+func parseScheduleStages(names []string) (Stage, error) {
+	var stages Stage
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case scheduleDownload:
+			stages |= StageDownload
+		case scheduleVerify:
+			stages |= StageVerify
+		case scheduleSync:
+			stages |= StagePurge | StageSync
+		default:
+			return 0, fmt.Errorf("invalid stage: %s", name)
+		}
+	}
+	return stages, nil
+}
+
+// Pause stops daemon from running scheduled cycles until Resume is called. The running
+// cycle is not affected.
+func (cfg *Config) Pause() {
+	if d := cfg.getDaemon(); d != nil && !d.paused.Swap(true) {
+		slog.Info("Paused scheduled tasks")
+	}
+}
+
+// Resume resumes scheduled cycles of daemon.
+func (cfg *Config) Resume() {
+	if d := cfg.getDaemon(); d != nil && d.paused.Swap(false) {
+		slog.Info("Resumed scheduled tasks")
+	}
+}
+
+// Cancel cancels the running cycle of daemon. It returns false if no cycle is running.
+func (cfg *Config) Cancel() bool {
+	d := cfg.getDaemon()
+	if d == nil || !d.cancelCycle() {
+		return false
+	}
+	slog.Info("Canceling the running cycle")
+	return true
+}
+
+func (cfg *Config) getDaemon() *daemon {
+	cfg.mux.Lock()
+	defer cfg.mux.Unlock()
+	return cfg.daemon
+}
+
+// startTriggers listens on SIGUSR1 and HTTP API to run a cycle immediately, until ctx
+// is canceled.
+func (cfg *Config) startTriggers(ctx context.Context) error {
+	if cfg.Listen != "" {
+		listener, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return err
+		}
+		go cfg.serve(ctx, listener)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(sigCh)
+		for {
+			select {
+			case <-sigCh:
+				if cfg.RunNow() {
+					slog.Info("Received SIGUSR1, a new cycle will be started immediately")
+				} else {
+					slog.Info("Received SIGUSR1, coalesced into the running cycle")
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (cfg *Config) cronLocation() (*time.Location, error) {
+	if cfg.CronTimezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(cfg.CronTimezone)
+}
+
+// cronLogger adapts logs of cron scheduler.
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...any) {
+	if msg == "skip" {
+		slog.Warn("Skipped scheduled task as the previous one is still running")
+	}
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...any) {
+	slog.Error("Scheduler error", "message", msg, "error", err)
+}
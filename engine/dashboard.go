@@ -0,0 +1,20 @@
+package engine
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// dashboardHandler serves the web dashboard embedded in the binary. It works offline, as
+// it loads no external assets.
+func dashboardHandler() http.Handler {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServerFS(sub)
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// EmbyClient is a client of Emby API, authenticated by an API key. Jellyfin keeps the
+// API of Emby it forked from, so it is served by the same client.
+type EmbyClient struct {
+	Endpoint *url.URL
+	APIKey   string
+	// Jellyfin is set if the server is Jellyfin.
+	Jellyfin bool
+
+	client *http.Client
+}
+
+func NewEmbyClient(endpoint, apiKey string) (*EmbyClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &EmbyClient{Endpoint: u, APIKey: apiKey, client: http.DefaultClient}, nil
+}
+
+func NewJellyfinClient(endpoint, apiKey string) (*EmbyClient, error) {
+	c, err := NewEmbyClient(endpoint, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	c.Jellyfin = true
+	return c, nil
+}
+
+func (c *EmbyClient) Name() string {
+	if c.Jellyfin {
+		return "Jellyfin"
+	}
+	return "Emby"
+}
+
+// Libraries returns virtual folders of the server.
+func (c *EmbyClient) Libraries(ctx context.Context) ([]*Library, error) {
+	resp, err := c.do(ctx, "GET", "Library/VirtualFolders", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var folders []struct {
+		Name      string   `json:"Name"`
+		ItemID    string   `json:"ItemId"`
+		Locations []string `json:"Locations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&folders); err != nil {
+		return nil, err
+	}
+	libs := make([]*Library, 0, len(folders))
+	for _, f := range folders {
+		libs = append(libs, &Library{ID: f.ItemID, Name: f.Name, Locations: f.Locations})
+	}
+	return libs, nil
+}
+
+// Update asks the server to scan the given folders.
+func (c *EmbyClient) Update(ctx context.Context, _ *Library, updates []*MediaUpdate) error {
+	p, err := json.Marshal(map[string]any{"Updates": updates})
+	if err != nil {
+		return err
+	}
+	return c.post(ctx, "Library/Media/Updated", nil, p)
+}
+
+// Refresh asks the server to scan a library recursively.
+func (c *EmbyClient) Refresh(ctx context.Context, lib *Library) error {
+	return c.RefreshItem(ctx, lib.ID)
+}
+
+// EmbyItem is an item of Emby library.
+type EmbyItem struct {
+	ID       string `json:"Id"`
+	Name     string `json:"Name"`
+	Type     string `json:"Type"`
+	Path     string `json:"Path"`
+	IsFolder bool   `json:"IsFolder"`
+}
+
+// embyItemsPageSize is the number of items to query at a time.
+const embyItemsPageSize = 1000
+
+// Items returns all items under a parent item, such as a library, recursively.
+func (c *EmbyClient) Items(ctx context.Context, parentID string) ([]*EmbyItem, error) {
+	var items []*EmbyItem
+	for {
+		query := url.Values{
+			"ParentId":   {parentID},
+			"Recursive":  {"true"},
+			"Fields":     {"Path"},
+			"StartIndex": {strconv.Itoa(len(items))},
+			"Limit":      {strconv.Itoa(embyItemsPageSize)},
+		}
+		resp, err := c.do(ctx, "GET", "Items", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items            []*EmbyItem `json:"Items"`
+			TotalRecordCount int         `json:"TotalRecordCount"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || len(items) >= page.TotalRecordCount {
+			return items, nil
+		}
+	}
+}
+
+// RefreshItem asks the server to refresh an item recursively, which removes items
+// whose files no longer exist.
+func (c *EmbyClient) RefreshItem(ctx context.Context, id string) error {
+	query := url.Values{
+		"Recursive":           {"true"},
+		"MetadataRefreshMode": {"Default"},
+		"ImageRefreshMode":    {"Default"},
+		"ReplaceAllMetadata":  {"false"},
+		"ReplaceAllImages":    {"false"},
+	}
+	return c.post(ctx, "Items/"+url.PathEscape(id)+"/Refresh", query, nil)
+}
+
+func (c *EmbyClient) post(ctx context.Context, path string, query url.Values, body []byte) error {
+	resp, err := c.do(ctx, "POST", path, query, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (c *EmbyClient) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := c.Endpoint.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", GlobalUserAgent)
+	if c.Jellyfin {
+		req.Header.Set("Authorization", fmt.Sprintf("MediaBrowser Token=%q", c.APIKey))
+	} else {
+		req.Header.Set("X-Emby-Token", c.APIKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// embyRequest is a request received by embyStub.
+type embyRequest struct {
+	Method string
+	Path   string
+	Token  string
+	Body   string
+}
+
+// embyStub stands in for an Emby server with a single library and the given items.
+type embyStub struct {
+	*httptest.Server
+
+	library string
+	items   []*EmbyItem
+
+	mu       sync.Mutex
+	requests []embyRequest
+}
+
+func newEmbyStub(t *testing.T, library string, items []*EmbyItem) *embyStub {
+	s := &embyStub{library: library, items: items}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *embyStub) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	token := r.Header.Get("X-Emby-Token")
+	if token == "" {
+		token = r.Header.Get("Authorization")
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, embyRequest{Method: r.Method, Path: r.URL.Path, Token: token, Body: string(body)})
+	s.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/Library/VirtualFolders":
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"Name": "Movies", "ItemId": "1", "Locations": []string{s.library}},
+		})
+	case r.Method == "GET" && r.URL.Path == "/Items":
+		json.NewEncoder(w).Encode(map[string]any{"Items": s.items, "TotalRecordCount": len(s.items)})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// posts returns POST requests received, other than queries.
+func (s *embyStub) posts() []embyRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var posts []embyRequest
+	for _, r := range s.requests {
+		if r.Method != "GET" {
+			posts = append(posts, r)
+		}
+	}
+	return posts
+}
+
+func TestRefreshMediaServers(t *testing.T) {
+	mediaDir := t.TempDir()
+	for _, dir := range []string{"电影/A", "电影/B"} {
+		if err := os.MkdirAll(filepath.Join(mediaDir, dir), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := []*Change{
+		{Path: "/电影/A/a.strm", Action: ChangeAdded},
+		{Path: "/电影/B/b.nfo", Action: ChangeUpdated},
+		{Path: "/电影/C/c.strm", Action: ChangeRemoved},
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		jellyfin  bool
+		want      []embyRequest
+	}{
+		{
+			name:      "changed folders",
+			threshold: 3,
+			want: []embyRequest{{
+				Method: "POST",
+				Path:   "/Library/Media/Updated",
+				Token:  "key",
+				Body:   `{"Updates":[{"Path":"/mnt/media/电影/A","UpdateType":"Created"},{"Path":"/mnt/media/电影/B","UpdateType":"Modified"},{"Path":"/mnt/media/电影/C","UpdateType":"Deleted"}]}`,
+			}},
+		},
+		{
+			name:      "library over threshold",
+			threshold: 2,
+			want:      []embyRequest{{Method: "POST", Path: "/Items/1/Refresh", Token: "key"}},
+		},
+		{
+			name:      "jellyfin",
+			threshold: 0,
+			jellyfin:  true,
+			want:      []embyRequest{{Method: "POST", Path: "/Items/1/Refresh", Token: `MediaBrowser Token="key"`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newEmbyStub(t, "/mnt/media/电影", nil)
+			cfg := &Config{MediaDir: mediaDir, MediaRefreshThreshold: tt.threshold}
+			if tt.jellyfin {
+				cfg.JellyfinURL, cfg.JellyfinAPIKey, cfg.JellyfinPathMap = stub.URL, "key", []string{mediaDir + "=/mnt/media"}
+			} else {
+				cfg.EmbyURL, cfg.EmbyAPIKey, cfg.EmbyPathMap = stub.URL, "key", []string{mediaDir + "=/mnt/media"}
+			}
+			rec := newRunRecord(StageSync)
+			for _, c := range changes {
+				rec.change(c)
+			}
+
+			cfg.refreshMediaServers(context.Background(), rec)
+			if got := stub.posts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requests = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunRecord is the outcome of a run of the pipeline.
+type RunRecord struct {
+	ID     int64     `json:"id"`
+	RunID  string    `json:"run_id"`
+	Stages string    `json:"stages"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Durations are seconds spent on each stage.
+	Durations  map[string]float64 `json:"durations"`
+	Downloaded int                `json:"downloaded"`
+	Skipped    int                `json:"skipped"`
+	Failed     int                `json:"failed"`
+	Purged     int                `json:"purged"`
+	// ValidDirs is the number of valid metadata directories per root directory.
+	ValidDirs map[string]int `json:"valid_dirs"`
+	// Changes are files changed in media directory per root directory.
+	Changes map[string]*RootChanges `json:"changes"`
+	// Dangling are Emby items whose files no longer exist, as reconciled after the run.
+	Dangling []*DanglingItem `json:"dangling,omitempty"`
+	Error    string          `json:"error,omitempty"`
+
+	// files are changed files in media directory, saved to changes table.
+	files []*Change
+}
+
+// RootChanges counts files changed in media directory under a root directory.
+type RootChanges struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+func newRunRecord(stages Stage) *RunRecord {
+	return &RunRecord{
+		RunID:     newRunID(),
+		Stages:    stages.String(),
+		Start:     time.Now(),
+		Durations: make(map[string]float64),
+		ValidDirs: make(map[string]int),
+		Changes:   make(map[string]*RootChanges),
+	}
+}
+
+// root returns changes of the root directory of a metadata file path.
+func (r *RunRecord) root(path string) *RootChanges {
+	name := rootLabel(path)
+	c := r.Changes[name]
+	if c == nil {
+		c = &RootChanges{}
+		r.Changes[name] = c
+	}
+	return c
+}
+
+// change records a file changed in media directory. Files rewritten without change
+// have empty action, and are ignored.
+func (r *RunRecord) change(c *Change) {
+	switch c.Action {
+	case ChangeAdded:
+		r.root(c.Path).Added++
+	case ChangeUpdated:
+		r.root(c.Path).Updated++
+	case ChangeRemoved:
+		r.root(c.Path).Removed++
+	default:
+		return
+	}
+	c.RunID, c.Time = r.RunID, time.Now()
+	r.files = append(r.files, c)
+}
+
+// changed reports whether any file is changed in media directory.
+func (r *RunRecord) changed() bool {
+	for _, c := range r.Changes {
+		if c.Added+c.Updated+c.Removed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// track records time spent on stage since start.
+func (r *RunRecord) track(stage Stage, start time.Time) {
+	r.Durations[stage.String()] += time.Since(start).Round(time.Millisecond).Seconds()
+}
+
+func (r *RunRecord) finish(err error) {
+	r.End = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *RunRecord) validDirs() int {
+	n := 0
+	for _, count := range r.ValidDirs {
+		n += count
+	}
+	return n
+}
+
+func createRunTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT NOT NULL DEFAULT '',
+		stages TEXT,
+		started_at TEXT,
+		ended_at TEXT,
+		durations TEXT,
+		downloaded INTEGER,
+		skipped INTEGER,
+		failed INTEGER,
+		purged INTEGER,
+		valid_dirs TEXT,
+		changes TEXT NOT NULL DEFAULT '{}',
+		dangling TEXT NOT NULL DEFAULT 'null',
+		error TEXT
+	)`)
+	return err
+}
+
+// saveRun appends r to run history.
+func (cfg *Config) saveRun(r *RunRecord) error {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	durations, err := json.Marshal(r.Durations)
+	if err != nil {
+		return err
+	}
+	validDirs, err := json.Marshal(r.ValidDirs)
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(r.Changes)
+	if err != nil {
+		return err
+	}
+	dangling, err := json.Marshal(r.Dangling)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO runs (run_id, stages, started_at, ended_at, durations, downloaded, skipped, failed, purged, valid_dirs, changes, dangling, error) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		r.RunID, r.Stages, r.Start.Format(time.RFC3339Nano), r.End.Format(time.RFC3339Nano), string(durations),
+		r.Downloaded, r.Skipped, r.Failed, r.Purged, string(validDirs), string(changes), string(dangling), r.Error)
+	if err != nil {
+		return err
+	}
+	if r.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	if err := saveChanges(tx, r.files); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listRuns returns the most recent runs, newest first.
+func (cfg *Config) listRuns(limit int) ([]*RunRecord, error) {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, run_id, stages, started_at, ended_at, durations, downloaded, skipped, failed, purged, valid_dirs, changes, dangling, error FROM runs ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*RunRecord
+	for rows.Next() {
+		var (
+			r                                       = &RunRecord{}
+			start, end                              string
+			durations, validDirs, changes, dangling string
+		)
+		if err := rows.Scan(&r.ID, &r.RunID, &r.Stages, &start, &end, &durations, &r.Downloaded, &r.Skipped, &r.Failed, &r.Purged, &validDirs, &changes, &dangling, &r.Error); err != nil {
+			return nil, err
+		}
+		if r.Start, err = time.Parse(time.RFC3339Nano, start); err != nil {
+			return nil, err
+		}
+		if r.End, err = time.Parse(time.RFC3339Nano, end); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(durations), &r.Durations); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(validDirs), &r.ValidDirs); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &r.Changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(dangling), &r.Dangling); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// printRuns prints runs as a table.
+func printRuns(w io.Writer, runs []*RunRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tRUN ID\tSTARTED\tELAPSED\tSTAGES\tDOWNLOADED\tSKIPPED\tFAILED\tPURGED\tVALID DIRS\tDANGLING\tERROR")
+	for _, r := range runs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			r.ID, r.RunID, r.Start.Local().Format(time.DateTime), r.End.Sub(r.Start).Round(time.Second), r.Stages,
+			r.Downloaded, r.Skipped, r.Failed, r.Purged, r.validDirs(), len(r.Dangling), strings.ReplaceAll(r.Error, "\n", " "))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const lockFileName = ".lock"
+
+// lockDirs takes an exclusive lock on each directory used by stages, which is held until
+// the returned function is called or the process exits.
+func (cfg *Config) lockDirs(stages Stage) (func(), error) {
+	dirs := []string{cfg.DownloadDir}
+	if stages&(StagePurge|StageSync) != 0 {
+		dirs = append(dirs, cfg.MediaDir)
+	}
+
+	var (
+		locked = make(map[string]bool)
+		files  []*os.File
+	)
+	unlock := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if locked[abs] {
+			continue
+		}
+		f, err := lockDir(abs)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locked[abs] = true
+		files = append(files, f)
+	}
+	return unlock, nil
+}
+
+// lockDir takes an exclusive lock on dir, and records PID and host of this process in
+// the lock file.
+func lockDir(dir string) (*os.File, error) {
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder := "another instance"
+			if p, err := os.ReadFile(path); err == nil {
+				var (
+					pid  int
+					host string
+				)
+				if _, err := fmt.Sscan(string(p), &pid, &host); err == nil {
+					holder = fmt.Sprintf("PID %d on host %s", pid, host)
+				}
+			}
+			return nil, fmt.Errorf("directory %s is locked by %s", dir, holder)
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "unknown"
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), strings.ReplaceAll(host, " ", "_"))), 0)
+	}
+	return f, nil
+}
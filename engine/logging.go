@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+// Formats of log records.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	defaultLogMaxSize    = 100 // MiB
+	defaultLogMaxBackups = 3
+)
+
+type (
+	runIDKey struct{}
+	stageKey struct{}
+)
+
+// withRunID returns a context whose log records carry id of the run.
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// withStage returns a context whose log records carry the stage.
+func withStage(ctx context.Context, stage Stage) context.Context {
+	return context.WithValue(ctx, stageKey{}, stage)
+}
+
+func newRunID() string {
+	p := make([]byte, 6)
+	rand.Read(p)
+	return hex.EncodeToString(p)
+}
+
+// contextHandler adds run_id and stage of context to log records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(runIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("run_id", id))
+	}
+	if stage, ok := ctx.Value(stageKey{}).(Stage); ok {
+		r.AddAttrs(slog.String("stage", stage.String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging sets the default logger as configured.
+func (cfg *Config) setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level: %s", cfg.LogLevel)
+	}
+	if cfg.LogMaxSize < 1 || cfg.LogMaxBackups < 0 {
+		return fmt.Errorf("log max size must be positive and max backups must not be negative")
+	}
+
+	var w io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := newRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case LogFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s", cfg.LogFormat)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+func (cfg *Config) bindLogFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&cfg.LogLevel, "log-level", "info", "Minimum level of logs: \"debug\", \"info\", \"warn\" or \"error\".")
+	flags.StringVar(&cfg.LogFormat, "log-format", LogFormatText, "Format of logs: \"text\" or \"json\".")
+	flags.StringVar(&cfg.LogFile, "log-file", "", "Write logs to this file instead of stderr, rotated by size.")
+	flags.IntVar(&cfg.LogMaxSize, "log-max-size", defaultLogMaxSize, "Maximum size in MiB of log file before it is rotated.")
+	flags.IntVar(&cfg.LogMaxBackups, "log-max-backups", defaultLogMaxBackups, "Maximum number of rotated log files to keep.")
+}
+
+// rotatingFile is a log file rotated when it exceeds max size. Rotated files are named
+// with suffixes .1, .2, ..., the lower the newer.
+type rotatingFile struct {
+	mux        sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+	// failed is set once a failure to rotate is reported, until a rotation succeeds.
+	failed bool
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, filePerm)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the log file to a backup, and opens a new one. The current file is closed
+// only once the new one is opened, so logs go on to it if rotation fails.
+func (rf *rotatingFile) rotate() error {
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		switch {
+		case err == nil:
+			rf.failed = false
+		case !rf.failed:
+			// Logs cannot be written about the log file itself.
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s, keep writing to the current file: %v\n", rf.path, err)
+			rf.failed = true
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
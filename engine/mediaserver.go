@@ -0,0 +1,297 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Types of media updates reported to media servers.
+const (
+	MediaCreated  = "Created"
+	MediaModified = "Modified"
+	MediaDeleted  = "Deleted"
+)
+
+const (
+	defaultMediaRefreshThreshold = 100
+	mediaServerTimeout           = 30 * time.Second
+)
+
+// MediaUpdate tells a media server that media under a folder is changed.
+type MediaUpdate struct {
+	Path       string `json:"Path"`
+	UpdateType string `json:"UpdateType"`
+}
+
+// Library is a library of a media server, with folders as seen by the server.
+type Library struct {
+	ID        string
+	Name      string
+	Locations []string
+}
+
+// contains reports whether p is in a folder of the library, and returns the length of
+// the folder to tell the most specific library.
+func (l *Library) contains(p string) (int, bool) {
+	longest, found := 0, false
+	for _, loc := range l.Locations {
+		loc = strings.TrimSuffix(loc, "/")
+		if (p == loc || strings.HasPrefix(p, loc+"/")) && len(loc) >= longest {
+			longest, found = len(loc), true
+		}
+	}
+	return longest, found
+}
+
+// MediaServer is a media server to scan media changed in media directory.
+type MediaServer interface {
+	// Name returns the product name of the server for logging.
+	Name() string
+	// Libraries returns libraries of the server.
+	Libraries(ctx context.Context) ([]*Library, error)
+	// Update scans changed folders of a library.
+	Update(ctx context.Context, lib *Library, updates []*MediaUpdate) error
+	// Refresh scans a library entirely.
+	Refresh(ctx context.Context, lib *Library) error
+}
+
+// mediaServer is a configured media server, with its path mapping.
+type mediaServer struct {
+	MediaServer
+	mapping pathMapping
+}
+
+// mediaServers returns media servers as configured.
+func (cfg *Config) mediaServers() ([]*mediaServer, error) {
+	var servers []*mediaServer
+	add := func(s MediaServer, err error, mapping []string) error {
+		if err != nil {
+			return err
+		}
+		m, err := parsePathMapping(mapping)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, &mediaServer{MediaServer: s, mapping: m})
+		return nil
+	}
+	if cfg.EmbyURL != "" {
+		s, err := NewEmbyClient(cfg.EmbyURL, cfg.EmbyAPIKey)
+		if err := add(s, err, cfg.EmbyPathMap); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JellyfinURL != "" {
+		s, err := NewJellyfinClient(cfg.JellyfinURL, cfg.JellyfinAPIKey)
+		if err := add(s, err, cfg.JellyfinPathMap); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PlexURL != "" {
+		s, err := NewPlexClient(cfg.PlexURL, cfg.PlexToken)
+		if err := add(s, err, cfg.PlexPathMap); err != nil {
+			return nil, err
+		}
+	}
+	return servers, nil
+}
+
+// pathMapping maps paths in media directory to paths seen by a media server.
+type pathMapping []struct{ from, to string }
+
+// parsePathMapping parses mappings in the form of "/local/path=/server/path".
+func parsePathMapping(ss []string) (pathMapping, error) {
+	var m pathMapping
+	for _, s := range ss {
+		from, to, ok := strings.Cut(s, "=")
+		if !ok || !filepath.IsAbs(from) || to == "" {
+			return nil, fmt.Errorf("invalid path mapping: %s", s)
+		}
+		m = append(m, struct{ from, to string }{filepath.Clean(from), strings.TrimSuffix(to, "/")})
+	}
+	// Longer prefixes take precedence.
+	sort.SliceStable(m, func(i, j int) bool { return len(m[i].from) > len(m[j].from) })
+	return m, nil
+}
+
+// apply returns the path seen by the media server of a local path.
+func (m pathMapping) apply(p string) string {
+	for _, each := range m {
+		if p == each.from {
+			return each.to
+		}
+		if rest, ok := strings.CutPrefix(p, each.from+"/"); ok {
+			return each.to + "/" + rest
+		}
+	}
+	return p
+}
+
+// local returns the local path of a path seen by the media server.
+func (m pathMapping) local(p string) string {
+	for _, each := range m {
+		if p == each.to {
+			return each.from
+		}
+		if rest, ok := strings.CutPrefix(p, each.to+"/"); ok {
+			return filepath.Join(each.from, rest)
+		}
+	}
+	return p
+}
+
+// changedDirs returns directories in media directory of changed files, with how each is
+// changed: deleted if it no longer exists, created if all its changes are additions,
+// modified otherwise.
+func changedDirs(mediaDir string, changes []*Change) map[string]string {
+	added := make(map[string]bool)
+	for _, c := range changes {
+		dir := path.Dir(c.Path)
+		if v, ok := added[dir]; ok {
+			added[dir] = v && c.Action == ChangeAdded
+		} else {
+			added[dir] = c.Action == ChangeAdded
+		}
+	}
+
+	dirs := make(map[string]string, len(added))
+	for dir, allAdded := range added {
+		local := filepath.Join(mediaDir, dir)
+		switch _, err := os.Stat(local); {
+		case errors.Is(err, os.ErrNotExist):
+			dirs[local] = MediaDeleted
+		case allAdded:
+			dirs[local] = MediaCreated
+		default:
+			dirs[local] = MediaModified
+		}
+	}
+	return dirs
+}
+
+// refreshMediaServers tells media servers about folders changed by a run. Failures are
+// logged only.
+func (cfg *Config) refreshMediaServers(ctx context.Context, r *RunRecord) {
+	if len(r.files) == 0 {
+		return
+	}
+	servers, err := cfg.mediaServers()
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid media server", "error", err)
+		return
+	}
+	if len(servers) == 0 {
+		return
+	}
+	mediaDir, err := filepath.Abs(cfg.MediaDir)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid media directory", "error", err)
+		return
+	}
+
+	// Changes are made, so media servers should know even if ctx is canceled.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mediaServerTimeout)
+	defer cancel()
+
+	dirs := changedDirs(mediaDir, r.files)
+	for _, s := range servers {
+		if err := cfg.refreshMediaServer(ctx, s, dirs); err != nil {
+			slog.WarnContext(ctx, "Failed to refresh media server", "server", s.Name(), "error", err)
+		}
+	}
+}
+
+// refreshMediaServer scans changed folders on the libraries containing them, or scans a
+// library entirely if too many of its folders are changed.
+func (cfg *Config) refreshMediaServer(ctx context.Context, s *mediaServer, dirs map[string]string) error {
+	libs, err := s.Libraries(ctx)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[*Library][]*MediaUpdate)
+	for dir, typ := range dirs {
+		p := s.mapping.apply(dir)
+		var (
+			lib     *Library
+			longest int
+		)
+		for _, each := range libs {
+			if n, ok := each.contains(p); ok && (lib == nil || n > longest) {
+				lib, longest = each, n
+			}
+		}
+		if lib == nil {
+			slog.DebugContext(ctx, "Folder is not in any library", "server", s.Name(), "path", p)
+			continue
+		}
+		updates[lib] = append(updates[lib], &MediaUpdate{Path: p, UpdateType: typ})
+	}
+
+	var errs []error
+	for lib, us := range updates {
+		if len(us) > cfg.MediaRefreshThreshold {
+			if err := s.Refresh(ctx, lib); err != nil {
+				errs = append(errs, fmt.Errorf("refresh library %s: %w", lib.Name, err))
+				continue
+			}
+			slog.InfoContext(ctx, "Refreshed library", "server", s.Name(), "library", lib.Name, "folders", len(us))
+			continue
+		}
+		sort.Slice(us, func(i, j int) bool { return us[i].Path < us[j].Path })
+		if err := s.Update(ctx, lib, us); err != nil {
+			errs = append(errs, fmt.Errorf("update library %s: %w", lib.Name, err))
+			continue
+		}
+		slog.InfoContext(ctx, "Scanned updated folders", "server", s.Name(), "library", lib.Name, "folders", len(us))
+	}
+	return errors.Join(errs...)
+}
+
+func (cfg *Config) validateMediaServers() error {
+	if cfg.MediaRefreshThreshold < 0 {
+		return fmt.Errorf("media refresh threshold must not be negative: %d", cfg.MediaRefreshThreshold)
+	}
+	for _, s := range []struct{ name, url, key string }{
+		{"Emby", cfg.EmbyURL, cfg.EmbyAPIKey},
+		{"Jellyfin", cfg.JellyfinURL, cfg.JellyfinAPIKey},
+		{"Plex", cfg.PlexURL, cfg.PlexToken},
+	} {
+		if s.url == "" {
+			continue
+		}
+		if u, err := url.Parse(s.url); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid %s url: %s", s.name, s.url)
+		}
+		if s.key == "" {
+			return fmt.Errorf("%s token is required", s.name)
+		}
+	}
+	_, err := cfg.mediaServers()
+	return err
+}
+
+func (cfg *Config) bindMediaServerFlags(flags *pflag.FlagSet) {
+	flags.IntVar(&cfg.MediaRefreshThreshold, "media-refresh-threshold", defaultMediaRefreshThreshold, "Refresh a library of media servers entirely instead if more folders than this are changed in it.")
+	flags.StringVar(&cfg.EmbyURL, "emby-url", "", "URL of Emby server to scan changed folders after each run, e.g. \"http://emby:8096\". Disabled if empty.")
+	flags.StringVar(&cfg.EmbyAPIKey, "emby-api-key", "", "API key of Emby server.")
+	flags.StringSliceVar(&cfg.EmbyPathMap, "emby-path-map", nil, "Map a path in media directory to the path seen by Emby, e.g. \"/media=/mnt/media\".")
+	flags.StringVar(&cfg.EmbyReconcile, "emby-reconcile", ReconcileOff, "What to do with Emby items whose files no longer exist in media directory after a purge: \"off\", \"report\", \"refresh\" or \"remove\" from library, leaving files untouched.")
+	flags.StringVar(&cfg.JellyfinURL, "jellyfin-url", "", "URL of Jellyfin server to scan changed folders after each run, e.g. \"http://jellyfin:8096\". Disabled if empty.")
+	flags.StringVar(&cfg.JellyfinAPIKey, "jellyfin-api-key", "", "API key of Jellyfin server.")
+	flags.StringSliceVar(&cfg.JellyfinPathMap, "jellyfin-path-map", nil, "Map a path in media directory to the path seen by Jellyfin, e.g. \"/media=/mnt/media\".")
+	flags.StringVar(&cfg.PlexURL, "plex-url", "", "URL of Plex server to scan changed folders after each run, e.g. \"http://plex:32400\". Disabled if empty.")
+	flags.StringVar(&cfg.PlexToken, "plex-token", "", "X-Plex-Token of Plex server.")
+	flags.StringSliceVar(&cfg.PlexPathMap, "plex-path-map", nil, "Map a path in media directory to the path seen by Plex, e.g. \"/media=/data/media\".")
+}
@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -79,6 +80,11 @@ type MetadataCrawler struct {
 	ignoredDirs       []string // TODO:
 	ignoredExtentions []string // TODO:
 	cleanup           bool
+
+	progress         *progress
+	progressInterval time.Duration
+	// failed is the number of files failed to download after retries.
+	failed atomic.Int64
 }
 
 type sortMirror struct {
@@ -86,7 +92,25 @@ type sortMirror struct {
 	duration time.Duration
 }
 
-func NewMetadataCrawler(downloadDir string, mirrors, selectedPaths, ignoredDirs, ignoredExtentions []string, cleanup bool) (*MetadataCrawler, error) {
+// MirrorHealth is the health of a metadata mirror as of its last validation.
+type MirrorHealth struct {
+	URL   string `json:"url"`
+	Valid bool   `json:"valid"`
+	// Rank is the order in which valid mirrors are preferred, starting from 1.
+	Rank int `json:"rank,omitempty"`
+	// Latency is the average of successful probes in seconds.
+	Latency float64 `json:"latency,omitempty"`
+	// Probes is the number of successful probes out of mirrorProbes.
+	Probes  int       `json:"probes"`
+	Checked time.Time `json:"checked"`
+}
+
+const mirrorProbes = 5
+
+// lastMirrorHealth is the health of mirrors as of the last validation by any crawler.
+var lastMirrorHealth atomic.Pointer[[]*MirrorHealth]
+
+func NewMetadataCrawler(ctx context.Context, downloadDir string, mirrors, selectedPaths, ignoredDirs, ignoredExtentions []string, cleanup bool) (*MetadataCrawler, error) {
 	mc := &MetadataCrawler{
 		client:            &http.Client{Timeout: 60 * time.Second},
 		downloadDir:       downloadDir,
@@ -94,6 +118,7 @@ func NewMetadataCrawler(downloadDir string, mirrors, selectedPaths, ignoredDirs,
 		ignoredDirs:       ignoredDirs,
 		ignoredExtentions: ignoredExtentions,
 		cleanup:           cleanup,
+		progress:          newProgress("crawl", "downloaded"),
 	}
 
 	if len(mirrors) == 0 {
@@ -103,7 +128,7 @@ func NewMetadataCrawler(downloadDir string, mirrors, selectedPaths, ignoredDirs,
 	}
 	var err error
 	for range 3 {
-		if err = mc.validateMirrors(); err == nil {
+		if err = mc.validateMirrors(ctx); err == nil || ctx.Err() != nil {
 			break
 		}
 	}
@@ -144,8 +169,8 @@ LOOP:
 	for {
 		select {
 		case <-ticker.C:
-			if err := mc.validateMirrors(); err != nil {
-				log.Printf("[ERROR] Failed to validate mirrors: %v", err)
+			if err := mc.validateMirrors(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to validate mirrors", "error", err)
 			}
 		case <-ctx.Done():
 			break LOOP
@@ -153,18 +178,25 @@ LOOP:
 	}
 }
 
-func (mc *MetadataCrawler) validateMirrors() error {
-	var mirrorsToSort []sortMirror
-	log.Println("[INFO] Validating metadata mirrors...")
+func (mc *MetadataCrawler) validateMirrors(ctx context.Context) error {
+	var (
+		mirrorsToSort []sortMirror
+		health        = make(map[string]*MirrorHealth)
+	)
+	slog.InfoContext(ctx, "Validating metadata mirrors")
 	for _, mirror := range mc.mirrors {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		dur := []time.Duration{}
-		for i := 0; i < 5; i++ {
-			if d := validateMirror(mirror); d > 0 {
+		for i := 0; i < mirrorProbes; i++ {
+			if d := validateMirror(ctx, mirror); d > 0 {
 				dur = append(dur, d)
 			}
 		}
+		health[mirror] = &MirrorHealth{URL: mirror, Probes: len(dur), Checked: time.Now()}
 		if len(dur) < 4 {
-			log.Printf("[WARN] Invalid metadata mirror: %s", mirror)
+			slog.WarnContext(ctx, "Invalid metadata mirror", "mirror", mirror)
 			continue
 		}
 		sum := time.Duration(0)
@@ -176,14 +208,24 @@ func (mc *MetadataCrawler) validateMirrors() error {
 			duration: sum / time.Duration(len(dur)),
 		}
 		mirrorsToSort = append(mirrorsToSort, m)
-		log.Printf("[INFO] Validated metadata mirror: %s (%dms)", mirror, m.duration/time.Millisecond)
+		slog.InfoContext(ctx, "Validated metadata mirror", "mirror", mirror, "latency", m.duration.Round(time.Millisecond))
 	}
 	sort.Slice(mirrorsToSort, func(i, j int) bool { return mirrorsToSort[i].duration < mirrorsToSort[j].duration })
 
 	var mirrors []string
-	for _, m := range mirrorsToSort {
+	for i, m := range mirrorsToSort {
 		mirrors = append(mirrors, m.mirror)
+		h := health[m.mirror]
+		h.Valid, h.Rank, h.Latency = true, i+1, m.duration.Round(time.Millisecond).Seconds()
+	}
+	ranked := make([]*MirrorHealth, 0, len(health))
+	for _, mirror := range mc.mirrors {
+		ranked = append(ranked, health[mirror])
 	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Valid && (!ranked[j].Valid || ranked[i].Rank < ranked[j].Rank)
+	})
+	lastMirrorHealth.Store(&ranked)
 	if len(mirrors) == 0 {
 		return fmt.Errorf("at least one metadata mirror is required")
 	}
@@ -202,14 +244,14 @@ func (mc *MetadataCrawler) activeMirrors() []string {
 	return mc.validMirrors
 }
 
-func (mc *MetadataCrawler) head(path, mirror string) (*MetadataFile, error) {
+func (mc *MetadataCrawler) head(ctx context.Context, path, mirror string) (*MetadataFile, error) {
 	u, err := url.Parse(mirror)
 	if err != nil {
 		return nil, &fs.PathError{Op: "Head", Path: path, Err: err}
 	}
 	u.Path = path
 
-	req, err := http.NewRequest("HEAD", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
 	if err != nil {
 		return nil, &fs.PathError{Op: "Head", Path: path, Err: err}
 	}
@@ -217,17 +259,21 @@ func (mc *MetadataCrawler) head(path, mirror string) (*MetadataFile, error) {
 
 	var resp *http.Response
 	for range 3 {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
 		resp, err = mc.client.Do(req)
 		if err != nil {
 			if err, ok := err.(*url.Error); ok {
 				err := err.Err
 				_, ok := err.(*net.OpError)
 				if ok || err == io.EOF {
-					time.Sleep(time.Second * 10)
+					sleepContext(ctx, time.Second*10)
 					continue
 				}
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		defer resp.Body.Close()
@@ -238,7 +284,7 @@ func (mc *MetadataCrawler) head(path, mirror string) (*MetadataFile, error) {
 			} else {
 				err = errors.New(resp.Status)
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		break
@@ -272,10 +318,10 @@ func (mc *MetadataCrawler) head(path, mirror string) (*MetadataFile, error) {
 	}, nil
 }
 
-func (mc *MetadataCrawler) Stat(path string) (fi os.FileInfo, err error) {
+func (mc *MetadataCrawler) Stat(ctx context.Context, path string) (fi os.FileInfo, err error) {
 	var file *MetadataFile
 	for _, mirror := range mc.activeMirrors() {
-		file, err = mc.head(path, mirror)
+		file, err = mc.head(ctx, path, mirror)
 		if err != nil {
 			continue
 		}
@@ -284,14 +330,14 @@ func (mc *MetadataCrawler) Stat(path string) (fi os.FileInfo, err error) {
 	return
 }
 
-func (mc *MetadataCrawler) get(path, mirror string) ([]*MetadataFile, error) {
+func (mc *MetadataCrawler) get(ctx context.Context, path, mirror string) ([]*MetadataFile, error) {
 	u, err := url.Parse(mirror)
 	if err != nil {
 		return nil, &fs.PathError{Op: "Get", Path: path, Err: err}
 	}
 	u.Path = filepath.Join(u.Path, path)
 
-	req, err := http.NewRequest("GET", strings.TrimSuffix(u.String(), "/")+"/", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(u.String(), "/")+"/", nil)
 	if err != nil {
 		return nil, &fs.PathError{Op: "Get", Path: path, Err: err}
 	}
@@ -299,17 +345,21 @@ func (mc *MetadataCrawler) get(path, mirror string) ([]*MetadataFile, error) {
 
 	var resp *http.Response
 	for range 3 {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
 		resp, err = mc.client.Do(req)
 		if err != nil {
 			if err, ok := err.(*url.Error); ok {
 				err := err.Err
 				_, ok := err.(*net.OpError)
 				if ok || err == io.EOF {
-					time.Sleep(time.Second * 10)
+					sleepContext(ctx, time.Second*10)
 					continue
 				}
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		defer resp.Body.Close()
@@ -320,7 +370,7 @@ func (mc *MetadataCrawler) get(path, mirror string) ([]*MetadataFile, error) {
 			} else {
 				err = errors.New(resp.Status)
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		break
@@ -388,10 +438,10 @@ func (mc *MetadataCrawler) get(path, mirror string) ([]*MetadataFile, error) {
 	return files, nil
 }
 
-func (mc *MetadataCrawler) ReadDir(path string) (fileInfos []os.FileInfo, err error) {
+func (mc *MetadataCrawler) ReadDir(ctx context.Context, path string) (fileInfos []os.FileInfo, err error) {
 	var files []*MetadataFile
 	for _, mirror := range mc.activeMirrors() {
-		files, err = mc.get(path, mirror)
+		files, err = mc.get(ctx, path, mirror)
 		if err != nil {
 			continue
 		}
@@ -404,12 +454,12 @@ func (mc *MetadataCrawler) ReadDir(path string) (fileInfos []os.FileInfo, err er
 	return
 }
 
-func (mc *MetadataCrawler) Walk(root string, fn WalkFunc) error {
-	info, err := mc.Stat(root)
+func (mc *MetadataCrawler) Walk(ctx context.Context, root string, fn WalkFunc) error {
+	info, err := mc.Stat(ctx, root)
 	if err != nil {
 		err = fn(root, nil, err)
 	} else {
-		err = mc.walk(root, info, fn)
+		err = mc.walk(ctx, root, info, fn)
 	}
 	if err == filepath.SkipDir || err == filepath.SkipAll {
 		return nil
@@ -417,12 +467,12 @@ func (mc *MetadataCrawler) Walk(root string, fn WalkFunc) error {
 	return err
 }
 
-func (mc *MetadataCrawler) walk(path string, info os.FileInfo, walkFn WalkFunc) error {
+func (mc *MetadataCrawler) walk(ctx context.Context, path string, info os.FileInfo, walkFn WalkFunc) error {
 	if !info.IsDir() {
 		return walkFn(path, info, nil)
 	}
 
-	fileInfos, err := mc.ReadDir(path)
+	fileInfos, err := mc.ReadDir(ctx, path)
 	err1 := walkFn(path, info, err)
 	// If err != nil, walk can't walk into this directory.
 	// err1 != nil means walkFn want walk to skip this directory or stop walking.
@@ -437,7 +487,7 @@ func (mc *MetadataCrawler) walk(path string, info os.FileInfo, walkFn WalkFunc)
 	sort.Slice(fileInfos, func(i, j int) bool { return fileInfos[i].Name() < fileInfos[j].Name() })
 
 	for _, fileInfo := range fileInfos {
-		err = mc.walk(filepath.Join(path, fileInfo.Name()), fileInfo, walkFn)
+		err = mc.walk(ctx, filepath.Join(path, fileInfo.Name()), fileInfo, walkFn)
 		if err != nil {
 			if !fileInfo.IsDir() || err != filepath.SkipDir {
 				return err
@@ -452,7 +502,9 @@ type failedEntry struct {
 	info *MetadataFile
 }
 
-func (mc *MetadataCrawler) Sync() error {
+// Sync downloads metadata updated on mirrors. Once ctx is canceled, no more file will be
+// downloaded, while downloads in progress are finished and committed.
+func (mc *MetadataCrawler) Sync(ctx context.Context) error {
 	if err := os.MkdirAll(mc.downloadDir, dirPerm); err != nil {
 		return err
 	}
@@ -473,6 +525,9 @@ func (mc *MetadataCrawler) Sync() error {
 	for _, file := range local {
 		localMap[file.Path()] = file
 	}
+	// Files of previous run give an estimate of the total.
+	mc.progress.expected.Store(int64(len(local)))
+	defer mc.progress.report(ctx, mc.progressInterval)()
 
 	selectedRoot := make(map[string]bool)
 	for _, path := range mc.selectedPaths {
@@ -486,18 +541,22 @@ func (mc *MetadataCrawler) Sync() error {
 	)
 	workerChan := make(chan struct{}, defaultWorkers())
 
-	if err := mc.Walk("/", func(path string, info os.FileInfo, err error) error {
+	if err := mc.Walk(ctx, "/", func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			log.Printf("[ERROR] Error validating metadata file: %v", err)
+			slog.ErrorContext(ctx, "Error validating metadata file", "path", path, "error", err)
 			return err
 		}
 		if info.IsDir() {
 			ss := strings.Split(strings.TrimPrefix(path, "/"), "/")
 			rootpath := ss[0]
 			if path != "/" && !selectedRoot[rootpath] {
-				log.Printf("[INFO] Skipped Directory: %s", path)
+				slog.InfoContext(ctx, "Skipped directory", "path", path)
 				return filepath.SkipDir
 			}
+			mc.progress.dirs.Add(1)
 			return nil
 		}
 
@@ -510,11 +569,12 @@ func (mc *MetadataCrawler) Sync() error {
 			fp := filepath.Join(mc.downloadDir, strings.TrimLeft(oldFile.Path(), "/"))
 			_, err = os.Stat(fp)
 			if err != nil {
-				log.Printf("[WARN] Missing file: %s", oldFile.Path())
+				slog.WarnContext(ctx, "Missing file", "path", oldFile.Path())
 				oldFile = nil
 			}
 		}
 
+		mc.progress.queued.Add(1)
 		wg.Add(1)
 		go func(path string, oldFile *MetadataFile) {
 			defer wg.Done()
@@ -522,7 +582,12 @@ func (mc *MetadataCrawler) Sync() error {
 			workerChan <- struct{}{}
 			defer func() { <-workerChan }()
 
-			tx, err := db.Begin()
+			if ctx.Err() != nil {
+				return
+			}
+
+			// Download in progress should be committed even if ctx is canceled.
+			tx, err := db.BeginTx(context.WithoutCancel(ctx), nil)
 			if err != nil {
 				mux.Lock()
 				defer mux.Unlock()
@@ -531,12 +596,13 @@ func (mc *MetadataCrawler) Sync() error {
 					path: path,
 					info: oldFile,
 				})
-				log.Printf("[ERROR] Critical DB error: %v", err)
+				mc.progress.failed.Add(1)
+				slog.ErrorContext(ctx, "Critical DB error", "path", path, "error", err)
 				return
 			}
 			defer tx.Rollback()
 
-			if err = mc.Download(tx, path, func(newFile *MetadataFile) bool {
+			if err = mc.Download(ctx, tx, path, func(newFile *MetadataFile) bool {
 				mux.Lock()
 				defer mux.Unlock()
 
@@ -547,29 +613,36 @@ func (mc *MetadataCrawler) Sync() error {
 				mux.Lock()
 				defer mux.Unlock()
 
-				log.Printf("[ERROR] Failed to download: %s", path)
+				slog.ErrorContext(ctx, "Failed to download", "path", path, "error", err)
 				failed = append(failed, failedEntry{
 					path: path,
 					info: oldFile,
 				})
+				mc.progress.failed.Add(1)
 			}
 		}(path, oldFile)
 
 		return nil
 	}); err != nil {
-		log.Printf("[ERROR] Critical error: %v", err)
+		slog.ErrorContext(ctx, "Critical error", "error", err)
 
 		wg.Wait()
 		return err
 	}
 
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mc.progress.queuedAll()
 
 	var (
 		failed2 []failedEntry
 		retry   int
 	)
 FINAL:
+	// Failed files are counted again if they fail to retry.
+	mc.progress.failed.Add(-int64(len(failed)))
 	for _, each := range failed {
 		wg.Add(1)
 		go func(path string, oldFile *MetadataFile) {
@@ -578,7 +651,11 @@ FINAL:
 			workerChan <- struct{}{}
 			defer func() { <-workerChan }()
 
-			tx, err := db.Begin()
+			if ctx.Err() != nil {
+				return
+			}
+
+			tx, err := db.BeginTx(context.WithoutCancel(ctx), nil)
 			if err != nil {
 				mux.Lock()
 				defer mux.Unlock()
@@ -587,12 +664,13 @@ FINAL:
 					path: path,
 					info: oldFile,
 				})
-				log.Printf("[ERROR] Critical DB error: %v", err)
+				mc.progress.failed.Add(1)
+				slog.ErrorContext(ctx, "Critical DB error", "path", path, "error", err)
 				return
 			}
 			defer tx.Rollback()
 
-			if err = mc.Download(tx, path, func(newFile *MetadataFile) bool {
+			if err = mc.Download(ctx, tx, path, func(newFile *MetadataFile) bool {
 				mux.Lock()
 				defer mux.Unlock()
 
@@ -604,54 +682,52 @@ FINAL:
 				defer mux.Unlock()
 
 				if os.IsNotExist(err) {
-					log.Printf("[WARN] Skipped to download as it appears to no longer exist on the mirror server: %s", path)
+					slog.WarnContext(ctx, "Skipped to download as it appears to no longer exist on the mirror server", "path", path)
+					mc.progress.skipped.Add(1)
 					delete(remoteMap, path)
 					return
 				}
 
-				log.Printf("[ERROR] Failed to download: %s", path)
+				slog.ErrorContext(ctx, "Failed to download", "path", path, "error", err)
 				failed2 = append(failed2, failedEntry{
 					path: path,
 					info: oldFile,
 				})
+				mc.progress.failed.Add(1)
 			}
 		}(each.path, each.info)
 	}
 
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if len(failed2) > 0 {
 		if retry > 5 {
-			log.Println("[ERROR] Metadata download has exceeded the maximum retry attempts.")
+			mc.failed.Store(int64(len(failed2)))
+			slog.ErrorContext(ctx, "Metadata download has exceeded the maximum retry attempts", "failed", len(failed2))
 			return fmt.Errorf("maximum retry attempts exceeded")
 		}
 		failed = make([]failedEntry, len(failed2))
 		copy(failed, failed2)
 		failed2 = failed2[:0]
 		retry++
-		log.Println("[INFO] Failed metadata entries will be retried...")
+		slog.InfoContext(ctx, "Failed metadata entries will be retried", "failed", len(failed))
 		goto FINAL
 	}
 
 	if mc.cleanup {
-		for _, oldFile := range local {
-			if file, ok := remoteMap[oldFile.Path()]; !ok {
-				tx, err := db.Begin()
-				if err != nil {
-					return err
-				}
-
-				if err := deleteFile(tx, oldFile); err != nil {
-					tx.Rollback()
-					continue
-				}
-				deleteDirIfEmpty(filepath.Dir(file.Path()))
-				tx.Rollback()
-			}
-		}
+		return cleanupFiles(ctx, db, mc.downloadDir, local, remoteMap)
 	}
 	return nil
 }
 
+// Stats returns the number of files downloaded, skipped as unchanged, and failed to
+// download by Sync.
+func (mc *MetadataCrawler) Stats() (downloaded, skipped, failed int) {
+	return int(mc.progress.done.Load()), int(mc.progress.skipped.Load()), int(mc.failed.Load())
+}
+
 func (mc *MetadataCrawler) LocalFiles() ([]*MetadataFile, error) {
 	db, err := sql.Open("sqlite3", filepath.Join(mc.downloadDir, ".metadata.db"))
 	if err != nil {
@@ -662,6 +738,22 @@ func (mc *MetadataCrawler) LocalFiles() ([]*MetadataFile, error) {
 	return mc.localFiles(db)
 }
 
+// LocalFilesReadOnly is like LocalFiles, but never creates or modifies the DB.
+func (mc *MetadataCrawler) LocalFilesReadOnly() ([]*MetadataFile, error) {
+	dbPath := filepath.Join(mc.downloadDir, ".metadata.db")
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return listFiles(db)
+}
+
 func (mc *MetadataCrawler) localFiles(db *sql.DB) ([]*MetadataFile, error) {
 	if err := createFileTable(db); err != nil {
 		return nil, err
@@ -669,14 +761,21 @@ func (mc *MetadataCrawler) localFiles(db *sql.DB) ([]*MetadataFile, error) {
 	return listFiles(db)
 }
 
-func (mc *MetadataCrawler) download(tx *sql.Tx, path, mirror string, filterFn func(f *MetadataFile) bool) (err error) {
+func (mc *MetadataCrawler) download(ctx context.Context, tx *sql.Tx, path, mirror string, filterFn func(f *MetadataFile) bool) (err error) {
+	defer func() {
+		if err != nil {
+			metricDownloads.WithLabelValues(mirrorLabel(mirror), downloadOutcomeFailed).Inc()
+		}
+	}()
+
 	u, err := url.Parse(mirror)
 	if err != nil {
 		return &fs.PathError{Op: "Get", Path: path, Err: err}
 	}
 	u.Path = filepath.Join(u.Path, path)
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	// A started download is not interrupted by ctx, so that it can be finished.
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "GET", u.String(), nil)
 	if err != nil {
 		return &fs.PathError{Op: "Get", Path: path, Err: err}
 	}
@@ -684,18 +783,22 @@ func (mc *MetadataCrawler) download(tx *sql.Tx, path, mirror string, filterFn fu
 
 	var resp *http.Response
 	for range 3 {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
 		resp, err = mc.client.Do(req)
 		if err != nil {
-			log.Printf("[WARN] Error downloading [%s] %s: %v", mirror, path, err)
+			slog.WarnContext(ctx, "Error downloading", "mirror", mirror, "path", path, "error", err)
 			if err, ok := err.(*url.Error); ok {
 				err := err.Err
 				_, ok := err.(*net.OpError)
 				if ok || err == io.EOF {
-					time.Sleep(time.Second * 10)
+					sleepContext(ctx, time.Second*10)
 					continue
 				}
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		defer resp.Body.Close()
@@ -706,7 +809,7 @@ func (mc *MetadataCrawler) download(tx *sql.Tx, path, mirror string, filterFn fu
 			} else {
 				err = errors.New(resp.Status)
 			}
-			time.Sleep(time.Second * 3)
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 		break
@@ -736,42 +839,40 @@ func (mc *MetadataCrawler) download(tx *sql.Tx, path, mirror string, filterFn fu
 	}
 
 	if filterFn == nil || filterFn(f) {
-		log.Printf("[INFO] Downloading [%s]: %s", mirror, path)
+		slog.DebugContext(ctx, "Downloading", "mirror", mirror, "path", path)
 		filePath := filepath.Join(mc.downloadDir, strings.TrimLeft(f.Path(), "/"))
 		if err := os.MkdirAll(filepath.Dir(filePath), dirPerm); err != nil {
 			return &fs.PathError{Op: "Get", Path: f.Path(), Err: err}
 		}
 
-		out, err := os.Create(filePath)
-		if err != nil {
-			return &fs.PathError{Op: "Get", Path: f.Path(), Err: err}
-		}
-		defer out.Close()
-
 		f.etag = resp.Header.Get("ETag")
 
-		if _, err := io.Copy(out, resp.Body); err != nil {
+		if err := writeFileAtomic(filePath, &countingReader{Reader: resp.Body, n: &mc.progress.bytes}); err != nil {
 			return &fs.PathError{Op: "Get", Path: f.Path(), Err: err}
 		}
 
 		if err = updateToDB(tx, f); err != nil {
 			return &fs.PathError{Op: "Get", Path: f.Path(), Err: err}
 		}
-		log.Printf("[INFO] Downloaded: %s", path)
+		mc.progress.done.Add(1)
+		metricDownloads.WithLabelValues(mirrorLabel(mirror), downloadOutcomeDownloaded).Inc()
+		slog.InfoContext(ctx, "Downloaded", "mirror", mirror, "path", path)
 		return nil
 	}
 
-	log.Printf("[INFO] Skipped: %s", f.Path())
+	mc.progress.skipped.Add(1)
+	metricDownloads.WithLabelValues(mirrorLabel(mirror), downloadOutcomeSkipped).Inc()
+	slog.DebugContext(ctx, "Skipped", "mirror", mirror, "path", f.Path())
 	return nil
 }
 
-func (mc *MetadataCrawler) Download(tx *sql.Tx, path string, filterFn func(f *MetadataFile) bool) (err error) {
+func (mc *MetadataCrawler) Download(ctx context.Context, tx *sql.Tx, path string, filterFn func(f *MetadataFile) bool) (err error) {
 	activeMirrors := mc.activeMirrors()
 	for i := range activeMirrors {
 		mirror := activeMirrors[i]
-		err = mc.download(tx, path, mirror, filterFn)
-		if err != nil && i < len(activeMirrors)-1 {
-			log.Printf("[WARN] Failed to download %s from mirror %s. It will be try again.", path, mirror)
+		err = mc.download(ctx, tx, path, mirror, filterFn)
+		if err != nil && ctx.Err() == nil && i < len(activeMirrors)-1 {
+			slog.WarnContext(ctx, "Failed to download from mirror, will try next mirror", "mirror", mirror, "path", path, "error", err)
 			continue
 		}
 		break
@@ -848,10 +949,15 @@ func isDirPath(path string) bool {
 	return name != "." && name != ".." && strings.HasSuffix(path, "/")
 }
 
-func validateMirror(url string) time.Duration {
+func validateMirror(ctx context.Context, url string) (d time.Duration) {
 	start := time.Now()
+	defer func() {
+		if ctx.Err() == nil {
+			observeMirrorValidation(url, start, d > 0)
+		}
+	}()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return 0
 	}
@@ -916,14 +1022,15 @@ func updateToDB(tx *sql.Tx, file *MetadataFile) error {
 	return tx.Commit()
 }
 
-func deleteFile(tx *sql.Tx, file *MetadataFile) error {
+// deleteFile removes file under root directory, and its record in DB.
+func deleteFile(tx *sql.Tx, root string, file *MetadataFile) error {
 	stmt, err := tx.Prepare("DELETE FROM files WHERE path = ?")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	if err := os.Remove(file.Path()); err != nil && !os.IsNotExist(err) {
+	if err := os.Remove(filepath.Join(root, file.Path())); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
@@ -934,6 +1041,28 @@ func deleteFile(tx *sql.Tx, file *MetadataFile) error {
 	return tx.Commit()
 }
 
+// cleanupFiles removes local files under root directory that are no longer on remote,
+// along with their records in DB and directories left empty.
+func cleanupFiles(ctx context.Context, db *sql.DB, root string, local []*MetadataFile, remote map[string]*MetadataFile) error {
+	for _, oldFile := range local {
+		if _, ok := remote[oldFile.Path()]; ok {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteFile(tx, root, oldFile); err != nil {
+			tx.Rollback()
+			continue
+		}
+		deleteDirIfEmpty(filepath.Join(root, filepath.Dir(oldFile.Path())))
+		tx.Rollback()
+	}
+	return nil
+}
+
 func listFiles(db *sql.DB) ([]*MetadataFile, error) {
 	rows, err := db.Query("SELECT path, name, size, modified, etag FROM files")
 	if err != nil {
@@ -967,6 +1096,45 @@ func pickFirstFile(db *sql.DB, path string) (*MetadataFile, error) {
 	return f, nil
 }
 
+// writeFileAtomic writes content of r to path through a temporary file in the same
+// directory, so that path never holds a partially written file.
+func writeFileAtomic(path string, r io.Reader) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Chmod(filePerm); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// sleepContext pauses for duration d, or until ctx is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func defaultWorkers() int {
 	cpus := runtime.NumCPU()
 	if cpus > 8 {
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCleanupFiles(t *testing.T) {
+	root := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(root, ".metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createFileTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var local []*MetadataFile
+	for _, path := range []string{"/电影/A/a.nfo", "/电影/B/b.nfo", "/电影/B/b.jpg", "/电影/C/c.nfo"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, path), nil, filePerm); err != nil {
+			t.Fatal(err)
+		}
+		f := &MetadataFile{path: path, name: filepath.Base(path)}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := updateToDB(tx, f); err != nil {
+			t.Fatal(err)
+		}
+		local = append(local, f)
+	}
+	remote := map[string]*MetadataFile{"/电影/A/a.nfo": local[0], "/电影/B/b.jpg": local[2]}
+
+	if err := cleanupFiles(context.Background(), db, root, local, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]bool{
+		"/电影/A/a.nfo": true,
+		"/电影/B/b.nfo": false,
+		"/电影/B/b.jpg": true,
+		"/电影/C/c.nfo": false,
+		"/电影/C":       false,
+	} {
+		if _, err := os.Stat(filepath.Join(root, path)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+	files, err := listFiles(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path())
+	}
+	sort.Strings(paths)
+	if want := []string{"/电影/A/a.nfo", "/电影/B/b.jpg"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("files in DB = %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "xiaoya_emby"
+
+// Outcomes of downloading a metadata file.
+const (
+	downloadOutcomeDownloaded = "downloaded"
+	downloadOutcomeSkipped    = "skipped"
+	downloadOutcomeFailed     = "failed"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "metadata_downloads_total",
+		Help:      "Metadata files requested from mirrors, by mirror and outcome.",
+	}, []string{"mirror", "outcome"})
+	metricMirrorValidation = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_validation_duration_seconds",
+		Help:      "Latency of validating metadata mirrors, by mirror and whether it is valid.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3},
+	}, []string{"mirror", "valid"})
+	metricAlistRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "alist_list_requests_total",
+		Help:      "Directory listings requested from Alist, by storage provider.",
+	}, []string{"provider"})
+	metricAlistErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "alist_list_errors_total",
+		Help:      "Directory listings failed on Alist, by storage provider.",
+	}, []string{"provider"})
+	metricAlistLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "alist_list_duration_seconds",
+		Help:      "Latency of directory listings on Alist, by storage provider.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"provider"})
+	metricAlistRateLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "alist_rate_limit",
+		Help:      "Current requests per second allowed to Alist, by storage provider.",
+	}, []string{"provider"})
+	metricFilesPurged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_purged_total",
+		Help:      "Files removed from media directory, by root directory.",
+	}, []string{"root"})
+	metricFilesSynced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_synced_total",
+		Help:      "Files written to media directory, by root directory.",
+	}, []string{"root"})
+	metricLastRunTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "End time of the last run, by stages.",
+	}, []string{"stages"})
+	metricLastRunSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_run_success",
+		Help:      "Whether the last run succeeded, by stages.",
+	}, []string{"stages"})
+	metricLastRunDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_run_duration_seconds",
+		Help:      "Duration of the last run, by stages.",
+	}, []string{"stages"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricDownloads,
+		metricMirrorValidation,
+		metricAlistRequests,
+		metricAlistErrors,
+		metricAlistLatency,
+		metricAlistRateLimit,
+		metricFilesPurged,
+		metricFilesSynced,
+		metricLastRunTime,
+		metricLastRunSuccess,
+		metricLastRunDuration,
+	)
+}
+
+// observeRun exports the outcome of a run.
+func observeRun(r *RunRecord) {
+	metricLastRunTime.WithLabelValues(r.Stages).Set(float64(r.End.UnixMilli()) / 1e3)
+	metricLastRunDuration.WithLabelValues(r.Stages).Set(r.End.Sub(r.Start).Seconds())
+	success := 0.0
+	if r.Error == "" {
+		success = 1
+	}
+	metricLastRunSuccess.WithLabelValues(r.Stages).Set(success)
+}
+
+// observeMirrorValidation exports latency of validating mirror since start.
+func observeMirrorValidation(mirror string, start time.Time, valid bool) {
+	label := "false"
+	if valid {
+		label = "true"
+	}
+	metricMirrorValidation.WithLabelValues(mirrorLabel(mirror), label).Observe(time.Since(start).Seconds())
+}
+
+// mirrorLabel returns host of mirror, to keep label values short.
+func mirrorLabel(mirror string) string {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Host == "" {
+		return mirror
+	}
+	return u.Host
+}
+
+// rootLabel returns root directory of a metadata file path.
+func rootLabel(path string) string {
+	root, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return root
+}
@@ -0,0 +1,379 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Events of notifications.
+const (
+	EventRunSucceeded = "run_succeeded"
+	EventRunFailed    = "run_failed"
+	EventLargePurge   = "large_purge"
+	EventCritical     = "critical"
+)
+
+// Policies of which runs to notify. Failures, large purges and critical errors are
+// always notified.
+const (
+	NotifyOnFailure = "failure"
+	NotifyOnChange  = "change"
+	NotifyOnAlways  = "always"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// Notification is sent to notifiers when a run finishes, or a critical error occurs.
+type Notification struct {
+	Event   string     `json:"event"`
+	Title   string     `json:"title"`
+	Message string     `json:"message"`
+	Host    string     `json:"host"`
+	Time    time.Time  `json:"time"`
+	Run     *RunRecord `json:"run,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// failed reports whether the notification is about a failure.
+func (n *Notification) failed() bool {
+	return n.Event == EventRunFailed || n.Event == EventCritical
+}
+
+// Notifier sends notifications.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// notifiers returns notifiers as configured.
+func (cfg *Config) notifiers() []Notifier {
+	var notifiers []Notifier
+	if cfg.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, &WebhookNotifier{URL: cfg.NotifyWebhookURL})
+	}
+	if cfg.NotifyNtfyURL != "" {
+		notifiers = append(notifiers, &NtfyNotifier{URL: cfg.NotifyNtfyURL, Token: cfg.NotifyNtfyToken})
+	}
+	if cfg.NotifyGotifyURL != "" {
+		notifiers = append(notifiers, &GotifyNotifier{URL: cfg.NotifyGotifyURL, Token: cfg.NotifyGotifyToken})
+	}
+	if cfg.NotifySMTPAddr != "" {
+		notifiers = append(notifiers, &SMTPNotifier{
+			Addr:     cfg.NotifySMTPAddr,
+			Username: cfg.NotifySMTPUsername,
+			Password: cfg.NotifySMTPPassword,
+			From:     cfg.NotifySMTPFrom,
+			To:       cfg.NotifySMTPTo,
+		})
+	}
+	return notifiers
+}
+
+func (cfg *Config) validateNotify() error {
+	switch cfg.NotifyOn {
+	case NotifyOnFailure, NotifyOnChange, NotifyOnAlways:
+	default:
+		return fmt.Errorf("invalid notify policy: %s", cfg.NotifyOn)
+	}
+	if cfg.NotifyPurgeThreshold < 0 {
+		return fmt.Errorf("notify purge threshold must not be negative: %d", cfg.NotifyPurgeThreshold)
+	}
+	for _, u := range []string{cfg.NotifyWebhookURL, cfg.NotifyNtfyURL, cfg.NotifyGotifyURL} {
+		if u == "" {
+			continue
+		}
+		if pu, err := url.Parse(u); err != nil || pu.Scheme != "http" && pu.Scheme != "https" {
+			return fmt.Errorf("invalid notify url: %s", u)
+		}
+	}
+	if cfg.NotifySMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.NotifySMTPAddr); err != nil {
+			return fmt.Errorf("invalid SMTP address: %s", cfg.NotifySMTPAddr)
+		}
+		if cfg.NotifySMTPFrom == "" || len(cfg.NotifySMTPTo) == 0 {
+			return fmt.Errorf("SMTP sender and recipients are required")
+		}
+	}
+	return nil
+}
+
+// notifyRun notifies the outcome of a run, if it is worth notifying.
+func (cfg *Config) notifyRun(ctx context.Context, r *RunRecord) {
+	var event string
+	switch {
+	case r.Error != "":
+		if ctx.Err() != nil {
+			// Stopped gracefully.
+			return
+		}
+		event = EventRunFailed
+	case cfg.NotifyPurgeThreshold > 0 && r.Purged >= cfg.NotifyPurgeThreshold:
+		event = EventLargePurge
+	case cfg.NotifyOn == NotifyOnAlways, cfg.NotifyOn == NotifyOnChange && r.changed():
+		event = EventRunSucceeded
+	default:
+		return
+	}
+
+	n := &Notification{Event: event, Run: r, Error: r.Error}
+	switch event {
+	case EventRunFailed:
+		n.Title = fmt.Sprintf("Run of %s failed", r.Stages)
+	case EventLargePurge:
+		n.Title = fmt.Sprintf("Run of %s purged %d files", r.Stages, r.Purged)
+	default:
+		n.Title = fmt.Sprintf("Run of %s succeeded", r.Stages)
+	}
+	cfg.notify(ctx, n)
+}
+
+// notifyCritical notifies a critical error out of runs.
+func (cfg *Config) notifyCritical(ctx context.Context, err error) {
+	cfg.notify(ctx, &Notification{
+		Event: EventCritical,
+		Title: "Critical error",
+		Error: err.Error(),
+	})
+}
+
+// notify sends n to all notifiers. Failures are logged only.
+func (cfg *Config) notify(ctx context.Context, n *Notification) {
+	notifiers := cfg.notifiers()
+	if len(notifiers) == 0 {
+		return
+	}
+
+	n.Time = time.Now()
+	n.Host, _ = os.Hostname()
+	n.Title = "xiaoya-emby: " + n.Title
+	n.Message = notificationMessage(n)
+
+	// Notifications of failures should be sent even if ctx is canceled.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+	defer cancel()
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			slog.WarnContext(ctx, "Failed to send notification", "notifier", fmt.Sprintf("%T", notifier), "event", n.Event, "error", err)
+		}
+	}
+}
+
+// notificationMessage returns plain text of n, with changes per root directory.
+func notificationMessage(n *Notification) string {
+	var b strings.Builder
+	if r := n.Run; r != nil {
+		fmt.Fprintf(&b, "Stages: %s\n", r.Stages)
+		fmt.Fprintf(&b, "Started: %s (took %v)\n", r.Start.Format(time.RFC3339), r.End.Sub(r.Start).Round(time.Second))
+		fmt.Fprintf(&b, "Downloaded: %d, failed: %d, purged: %d\n", r.Downloaded, r.Failed, r.Purged)
+
+		roots := make([]string, 0, len(r.Changes))
+		for root := range r.Changes {
+			roots = append(roots, root)
+		}
+		sort.Strings(roots)
+		for _, root := range roots {
+			c := r.Changes[root]
+			fmt.Fprintf(&b, "%s: %d added, %d updated, %d removed\n", root, c.Added, c.Updated, c.Removed)
+		}
+		if len(r.Dangling) > 0 {
+			actions := make(map[string]int)
+			for _, item := range r.Dangling {
+				actions[item.Action]++
+			}
+			fmt.Fprintf(&b, "Dangling Emby items: %d (%d refreshed, %d removed)\n", len(r.Dangling), actions[danglingRefreshed], actions[danglingRemoved])
+		}
+	}
+	if n.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", n.Error)
+	}
+	if n.Host != "" {
+		fmt.Fprintf(&b, "Host: %s\n", n.Host)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// WebhookNotifier posts notifications in JSON.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	p, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doNotifyRequest(req)
+}
+
+// NtfyNotifier publishes notifications to a ntfy topic, e.g. "https://ntfy.sh/mytopic".
+type NtfyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (t *NtfyNotifier) Notify(ctx context.Context, n *Notification) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", n.Title))
+	if n.failed() {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	return doNotifyRequest(req)
+}
+
+// GotifyNotifier sends notifications to a Gotify server, e.g. "https://gotify.example.com".
+type GotifyNotifier struct {
+	URL   string
+	Token string
+}
+
+func (g *GotifyNotifier) Notify(ctx context.Context, n *Notification) error {
+	priority := 5
+	if n.failed() {
+		priority = 8
+	}
+	p, err := json.Marshal(map[string]any{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": priority,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(g.URL, "/")+"/message", bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.Token)
+	return doNotifyRequest(req)
+}
+
+func doNotifyRequest(req *http.Request) error {
+	req.Header.Set("User-Agent", GlobalUserAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier sends notifications by email. STARTTLS is used if the server supports it.
+type SMTPNotifier struct {
+	// Addr is host:port of SMTP server.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s *SMTPNotifier) Notify(ctx context.Context, n *Notification) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(n.Message, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (cfg *Config) bindNotifyFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&cfg.NotifyOn, "notify-on", NotifyOnFailure, "Which runs to notify: \"failure\", \"change\" (files added, updated or removed) or \"always\". Failures and large purges are always notified.")
+	flags.IntVar(&cfg.NotifyPurgeThreshold, "notify-purge-threshold", 100, "Notify a run purging at least this many files. Disabled if 0.")
+	flags.StringVar(&cfg.NotifyWebhookURL, "notify-webhook-url", "", "URL to post notifications to in JSON.")
+	flags.StringVar(&cfg.NotifyNtfyURL, "notify-ntfy-url", "", "URL of ntfy topic to publish notifications to, e.g. \"https://ntfy.sh/mytopic\".")
+	flags.StringVar(&cfg.NotifyNtfyToken, "notify-ntfy-token", "", "Access token of ntfy.")
+	flags.StringVar(&cfg.NotifyGotifyURL, "notify-gotify-url", "", "URL of Gotify server to send notifications to.")
+	flags.StringVar(&cfg.NotifyGotifyToken, "notify-gotify-token", "", "Application token of Gotify.")
+	flags.StringVar(&cfg.NotifySMTPAddr, "notify-smtp-addr", "", "Address of SMTP server to send notifications by email, e.g. \"smtp.example.com:587\".")
+	flags.StringVar(&cfg.NotifySMTPUsername, "notify-smtp-username", "", "Username of SMTP server.")
+	flags.StringVar(&cfg.NotifySMTPPassword, "notify-smtp-password", "", "Password of SMTP server.")
+	flags.StringVar(&cfg.NotifySMTPFrom, "notify-smtp-from", "", "Sender of notification emails.")
+	flags.StringSliceVar(&cfg.NotifySMTPTo, "notify-smtp-to", nil, "Recipients of notification emails.")
+}
@@ -0,0 +1,297 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyRequest is a request received by a stub notification server.
+type notifyRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+func TestHTTPNotifiers(t *testing.T) {
+	succeeded := &Notification{Event: EventRunSucceeded, Title: "xiaoya-emby: Run of sync succeeded", Message: "Stages: sync\nPurged: 0"}
+	failed := &Notification{Event: EventRunFailed, Title: "xiaoya-emby: 同步失败", Message: "Error: x", Error: "x"}
+
+	tests := []struct {
+		name     string
+		notifier func(url string) Notifier
+		n        *Notification
+		check    func(t *testing.T, r notifyRequest)
+	}{
+		{
+			name:     "webhook",
+			notifier: func(url string) Notifier { return &WebhookNotifier{URL: url + "/hook"} },
+			n:        failed,
+			check: func(t *testing.T, r notifyRequest) {
+				if r.Path != "/hook" || r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("request = %s %s, want JSON post to /hook", r.Method, r.Path)
+				}
+				var got Notification
+				if err := json.Unmarshal([]byte(r.Body), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Event != EventRunFailed || got.Title != failed.Title || got.Error != "x" {
+					t.Errorf("payload = %s", r.Body)
+				}
+			},
+		},
+		{
+			name:     "ntfy",
+			notifier: func(url string) Notifier { return &NtfyNotifier{URL: url + "/topic", Token: "tk"} },
+			n:        succeeded,
+			check: func(t *testing.T, r notifyRequest) {
+				if r.Path != "/topic" || r.Body != succeeded.Message {
+					t.Errorf("request = %s %q, want message posted to /topic", r.Path, r.Body)
+				}
+				if got := r.Header.Get("Title"); got != succeeded.Title {
+					t.Errorf("Title = %q, want %q", got, succeeded.Title)
+				}
+				if got := r.Header.Get("Authorization"); got != "Bearer tk" {
+					t.Errorf("Authorization = %q, want Bearer tk", got)
+				}
+				if got := r.Header.Get("Priority"); got != "" {
+					t.Errorf("Priority = %q, want default", got)
+				}
+			},
+		},
+		{
+			name:     "ntfy failure",
+			notifier: func(url string) Notifier { return &NtfyNotifier{URL: url + "/topic"} },
+			n:        failed,
+			check: func(t *testing.T, r notifyRequest) {
+				if got := r.Header.Get("Title"); got != "=?utf-8?q?xiaoya-emby:_=E5=90=8C=E6=AD=A5=E5=A4=B1=E8=B4=A5?=" {
+					t.Errorf("Title = %q, want Q-encoded", got)
+				}
+				if r.Header.Get("Priority") != "high" || r.Header.Get("Tags") != "warning" {
+					t.Errorf("Priority, Tags = %q, %q, want high, warning", r.Header.Get("Priority"), r.Header.Get("Tags"))
+				}
+				if got := r.Header.Get("Authorization"); got != "" {
+					t.Errorf("Authorization = %q, want none", got)
+				}
+			},
+		},
+		{
+			name:     "gotify",
+			notifier: func(url string) Notifier { return &GotifyNotifier{URL: url + "/", Token: "app"} },
+			n:        failed,
+			check: func(t *testing.T, r notifyRequest) {
+				if r.Path != "/message" || r.Header.Get("X-Gotify-Key") != "app" {
+					t.Errorf("request = %s with key %q, want /message with key app", r.Path, r.Header.Get("X-Gotify-Key"))
+				}
+				var got map[string]any
+				if err := json.Unmarshal([]byte(r.Body), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got["title"] != failed.Title || got["message"] != failed.Message || got["priority"] != float64(8) {
+					t.Errorf("payload = %s", r.Body)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests []notifyRequest
+				status   = http.StatusOK
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, notifyRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: string(body)})
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			notifier := tt.notifier(server.URL)
+			if err := notifier.Notify(context.Background(), tt.n); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			if len(requests) != 1 || requests[0].Method != "POST" {
+				t.Fatalf("requests = %+v, want a POST", requests)
+			}
+			tt.check(t, requests[0])
+			status = http.StatusUnauthorized
+			mu.Unlock()
+
+			if err := notifier.Notify(context.Background(), tt.n); err == nil || !strings.Contains(err.Error(), "401") {
+				t.Errorf("Notify = %v, want error of 401", err)
+			}
+		})
+	}
+}
+
+// smtpStub is a plain SMTP server accepting PLAIN auth, and rejecting recipients of
+// rejectDomain.
+type smtpStub struct {
+	net.Listener
+	rejectDomain string
+
+	mu       sync.Mutex
+	auth     string
+	from     string
+	to       []string
+	data     string
+	sessions sync.WaitGroup
+}
+
+func newSMTPStub(t *testing.T, rejectDomain string) *smtpStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{Listener: l, rejectDomain: rejectDomain}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.sessions.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		s.sessions.Wait()
+	})
+	return s
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer s.sessions.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 stub ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			tc.PrintfLine("250-stub\r\n250 AUTH PLAIN")
+		case "AUTH":
+			_, resp, _ := strings.Cut(arg, " ")
+			p, _ := base64.StdEncoding.DecodeString(resp)
+			s.auth = string(p)
+			tc.PrintfLine("235 OK")
+		case "MAIL":
+			s.from = arg
+			tc.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rejectDomain != "" && strings.Contains(arg, "@"+s.rejectDomain) {
+				tc.PrintfLine("550 no such user")
+				break
+			}
+			s.to = append(s.to, arg)
+			tc.PrintfLine("250 OK")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			p, err := io.ReadAll(tc.DotReader())
+			if err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.data = string(p)
+			tc.PrintfLine("250 OK")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			s.mu.Unlock()
+			return
+		default:
+			tc.PrintfLine("502 not implemented")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	n := &Notification{
+		Event:   EventRunFailed,
+		Title:   "xiaoya-emby: 同步失败",
+		Message: "Stages: sync\nError: x",
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	stub := newSMTPStub(t, "")
+	notifier := &SMTPNotifier{
+		Addr:     stub.Addr().String(),
+		Username: "user",
+		Password: "pass",
+		From:     "bot@example.com",
+		To:       []string{"a@example.com", "b@example.com"},
+	}
+	if err := notifier.Notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.auth != "\x00user\x00pass" {
+		t.Errorf("auth = %q, want PLAIN of user and pass", stub.auth)
+	}
+	if stub.from != "FROM:<bot@example.com>" || strings.Join(stub.to, ",") != "TO:<a@example.com>,TO:<b@example.com>" {
+		t.Errorf("envelope = %s %v", stub.from, stub.to)
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(stub.data)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"From":         "bot@example.com",
+		"To":           "a@example.com, b@example.com",
+		"Subject":      "=?utf-8?q?xiaoya-emby:_=E5=90=8C=E6=AD=A5=E5=A4=B1=E8=B4=A5?=",
+		"Date":         "Tue, 02 Jan 2024 03:04:05 +0000",
+		"Content-Type": "text/plain; charset=UTF-8",
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if body, _ := io.ReadAll(r.R); string(body) != "Stages: sync\nError: x\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPNotifierRejected(t *testing.T) {
+	stub := newSMTPStub(t, "rejected.example.com")
+	notifier := &SMTPNotifier{
+		Addr: stub.Addr().String(),
+		From: "bot@example.com",
+		To:   []string{"a@example.com", "b@rejected.example.com"},
+	}
+	err := notifier.Notify(context.Background(), &Notification{Event: EventRunFailed, Title: "x"})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("Notify = %v, want error of 550", err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.auth != "" || stub.data != "" {
+		t.Errorf("auth, data = %q, %q, want neither without username and with a rejected recipient", stub.auth, stub.data)
+	}
+}
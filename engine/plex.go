@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// PlexClient is a client of Plex Media Server, authenticated by an X-Plex-Token.
+type PlexClient struct {
+	Endpoint *url.URL
+	Token    string
+
+	client *http.Client
+}
+
+func NewPlexClient(endpoint, token string) (*PlexClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &PlexClient{Endpoint: u, Token: token, client: http.DefaultClient}, nil
+}
+
+func (c *PlexClient) Name() string {
+	return "Plex"
+}
+
+// Libraries returns library sections of the server.
+func (c *PlexClient) Libraries(ctx context.Context) ([]*Library, error) {
+	resp, err := c.get(ctx, "library/sections", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		MediaContainer struct {
+			Directory []struct {
+				Key      string `json:"key"`
+				Title    string `json:"title"`
+				Location []struct {
+					Path string `json:"path"`
+				} `json:"Location"`
+			} `json:"Directory"`
+		} `json:"MediaContainer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	var libs []*Library
+	for _, d := range body.MediaContainer.Directory {
+		lib := &Library{ID: d.Key, Name: d.Title}
+		for _, loc := range d.Location {
+			lib.Locations = append(lib.Locations, loc.Path)
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// Update runs a partial scan of a section on each changed folder. A deleted folder is
+// scanned by its parent, for Plex to find the media missing.
+func (c *PlexClient) Update(ctx context.Context, lib *Library, updates []*MediaUpdate) error {
+	scanned := make(map[string]bool)
+	for _, u := range updates {
+		p := u.Path
+		if u.UpdateType == MediaDeleted {
+			if parent := path.Dir(p); parent != p {
+				if _, ok := lib.contains(parent); ok {
+					p = parent
+				}
+			}
+		}
+		if scanned[p] {
+			continue
+		}
+		scanned[p] = true
+		if err := c.refresh(ctx, lib, url.Values{"path": {p}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh scans a section entirely.
+func (c *PlexClient) Refresh(ctx context.Context, lib *Library) error {
+	return c.refresh(ctx, lib, nil)
+}
+
+func (c *PlexClient) refresh(ctx context.Context, lib *Library, query url.Values) error {
+	resp, err := c.get(ctx, "library/sections/"+url.PathEscape(lib.ID)+"/refresh", query)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (c *PlexClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.Endpoint.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", GlobalUserAgent)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", c.Token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const defaultProgressInterval = 30 * time.Second
+
+// progress tracks a long running task, e.g. crawling mirrors, and reports it periodically.
+type progress struct {
+	// task is the name of the task in reports.
+	task string
+	// doneLabel names items done in reports, e.g. "downloaded".
+	doneLabel string
+	start     time.Time
+
+	// expected is the estimated number of items, e.g. the file count of previous run.
+	expected atomic.Int64
+	// exact is set once all items are queued, so that queued is the exact total.
+	exact atomic.Bool
+
+	dirs    atomic.Int64
+	queued  atomic.Int64
+	done    atomic.Int64
+	skipped atomic.Int64
+	failed  atomic.Int64
+	bytes   atomic.Int64
+}
+
+func newProgress(task, doneLabel string) *progress {
+	return &progress{task: task, doneLabel: doneLabel, start: time.Now()}
+}
+
+// queuedAll marks that all items are queued.
+func (p *progress) queuedAll() {
+	p.exact.Store(true)
+}
+
+// report logs progress every interval until the returned function is called, which
+// logs the final progress. Nothing is logged if interval is not positive.
+func (p *progress) report(ctx context.Context, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.log(ctx, "Progress")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		p.log(ctx, "Progress finished")
+	}
+}
+
+func (p *progress) log(ctx context.Context, msg string) {
+	elapsed := time.Since(p.start)
+	done, skipped, failed := p.done.Load(), p.skipped.Load(), p.failed.Load()
+	processed := done + skipped + failed
+
+	attrs := []any{"task", p.task}
+	if dirs := p.dirs.Load(); dirs > 0 {
+		attrs = append(attrs, "dirs", dirs)
+	}
+	attrs = append(attrs,
+		"queued", p.queued.Load(),
+		p.doneLabel, done,
+		"skipped", skipped,
+		"failed", failed,
+		"bytes", p.bytes.Load(),
+		"elapsed", elapsed.Round(time.Second),
+	)
+	if secs := elapsed.Seconds(); secs > 0 {
+		attrs = append(attrs,
+			"items_per_sec", float64(int64(float64(processed)/secs*10))/10,
+			"bytes_per_sec", int64(float64(p.bytes.Load())/secs),
+		)
+	}
+	if eta, ok := p.eta(processed, elapsed); ok {
+		attrs = append(attrs, "eta", eta.Round(time.Second))
+	}
+	slog.InfoContext(ctx, msg, attrs...)
+}
+
+// total returns the exact or estimated number of items.
+func (p *progress) total() int64 {
+	total := p.expected.Load()
+	if queued := p.queued.Load(); p.exact.Load() || queued > total {
+		total = queued
+	}
+	return total
+}
+
+// eta estimates time remaining by the rate of items processed so far.
+func (p *progress) eta(processed int64, elapsed time.Duration) (time.Duration, bool) {
+	total := p.total()
+	if processed == 0 || total == 0 {
+		return 0, false
+	}
+	if processed >= total {
+		return 0, true
+	}
+	return time.Duration(float64(elapsed) * float64(total-processed) / float64(processed)), true
+}
+
+// ProgressStatus is a snapshot of progress of a running task.
+type ProgressStatus struct {
+	Task    string `json:"task"`
+	Dirs    int64  `json:"dirs,omitempty"`
+	Total   int64  `json:"total"`
+	Queued  int64  `json:"queued"`
+	Done    int64  `json:"done"`
+	Skipped int64  `json:"skipped"`
+	Failed  int64  `json:"failed"`
+	Bytes   int64  `json:"bytes"`
+	// Elapsed and ETA are in seconds. ETA is absent until it can be estimated.
+	Elapsed float64  `json:"elapsed"`
+	ETA     *float64 `json:"eta,omitempty"`
+}
+
+func (p *progress) status() *ProgressStatus {
+	elapsed := time.Since(p.start)
+	s := &ProgressStatus{
+		Task:    p.task,
+		Dirs:    p.dirs.Load(),
+		Total:   p.total(),
+		Queued:  p.queued.Load(),
+		Done:    p.done.Load(),
+		Skipped: p.skipped.Load(),
+		Failed:  p.failed.Load(),
+		Bytes:   p.bytes.Load(),
+		Elapsed: elapsed.Round(time.Second).Seconds(),
+	}
+	if eta, ok := p.eta(s.Done+s.Skipped+s.Failed, elapsed); ok {
+		secs := eta.Round(time.Second).Seconds()
+		s.ETA = &secs
+	}
+	return s
+}
+
+// countingReader counts bytes read into n.
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
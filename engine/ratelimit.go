@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitProvider is the key of rate limit for providers not configured.
+const defaultRateLimitProvider = "default"
+
+// builtinRateLimit applies to providers not configured if "default" is not configured
+// either, so that paths whose provider is not known yet are not left unlimited.
+var builtinRateLimit = &RateLimit{Rate: 10, Burst: 10}
+
+const (
+	// rateLimitFloor is the fraction of the configured rate to back off down to.
+	rateLimitFloor = 1.0 / 32
+	// rateLimitStep is the fraction of the configured rate recovered by a success.
+	rateLimitStep = 1.0 / 16
+	// rateLimitBackoffInterval is the minimum interval between two backoffs, so that
+	// failures of concurrent requests back off once.
+	rateLimitBackoffInterval = time.Second
+)
+
+// RateLimit is the rate of requests to a storage provider of Alist.
+type RateLimit struct {
+	// Rate is requests per second.
+	Rate float64
+	// Burst is requests allowed at once.
+	Burst int
+}
+
+// parseRateLimits parses rate limits in the form of "provider=rate[:burst]". Providers
+// are matched case-insensitively, and "default" applies to the others.
+func parseRateLimits(m map[string]string) (map[string]*RateLimit, error) {
+	limits := make(map[string]*RateLimit, len(m))
+	for provider, s := range m {
+		rate, burst, hasBurst := strings.Cut(s, ":")
+		limit := &RateLimit{}
+		var err error
+		if limit.Rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || limit.Rate <= 0 {
+			return nil, fmt.Errorf("invalid rate limit of %s: %s", provider, s)
+		}
+		limit.Burst = max(1, int(math.Ceil(limit.Rate)))
+		if hasBurst {
+			if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || limit.Burst < 1 {
+				return nil, fmt.Errorf("invalid rate limit burst of %s: %s", provider, s)
+			}
+		}
+		limits[strings.ToLower(strings.TrimSpace(provider))] = limit
+	}
+	return limits, nil
+}
+
+// tokenBucket limits the rate of requests to a storage provider. The rate backs off by
+// half on each failure down to a floor, and recovers step by step as requests succeed.
+type tokenBucket struct {
+	provider string
+	limit    *RateLimit
+
+	mu          sync.Mutex
+	rate        float64
+	tokens      float64
+	last        time.Time
+	lastBackoff time.Time
+}
+
+func newTokenBucket(provider string, limit *RateLimit) *tokenBucket {
+	b := &tokenBucket{
+		provider: provider,
+		limit:    limit,
+		rate:     limit.Rate,
+		tokens:   float64(limit.Burst),
+		last:     time.Now(),
+	}
+	metricAlistRateLimit.WithLabelValues(provider).Set(b.rate)
+	return b
+}
+
+// wait blocks until a request is allowed, or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// Take the token now, and wait for it to be refilled if in debt.
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// No request is made, so give the token back.
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// done adjusts the rate by the result of a request.
+func (b *tokenBucket) done(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !throttled(err) {
+		b.rate = min(b.limit.Rate, b.rate+b.limit.Rate*rateLimitStep)
+		metricAlistRateLimit.WithLabelValues(b.provider).Set(b.rate)
+		return
+	}
+	if time.Since(b.lastBackoff) < rateLimitBackoffInterval {
+		return
+	}
+	b.lastBackoff = time.Now()
+	rate := max(b.limit.Rate*rateLimitFloor, b.rate/2)
+	if rate < b.rate {
+		slog.WarnContext(ctx, "Slow down requests to Alist", "provider", b.provider, "rate", rate, "error", err)
+	}
+	b.rate = rate
+	metricAlistRateLimit.WithLabelValues(b.provider).Set(b.rate)
+}
+
+// throttled reports whether err tells Alist or its storage is overwhelmed. A path not
+// found or unauthorized is an answer, not a sign of throttling.
+func throttled(err error) bool {
+	return err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrUnauthorized) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
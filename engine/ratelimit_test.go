@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		in      map[string]string
+		want    map[string]*RateLimit
+		wantErr bool
+	}{
+		{
+			in:   map[string]string{" 115 Cloud ": "2", "default": "0.5"},
+			want: map[string]*RateLimit{"115 cloud": {Rate: 2, Burst: 2}, "default": {Rate: 0.5, Burst: 1}},
+		},
+		{
+			in:   map[string]string{"Quark": "3 : 5"},
+			want: map[string]*RateLimit{"quark": {Rate: 3, Burst: 5}},
+		},
+		{in: map[string]string{"quark": "0"}, wantErr: true},
+		{in: map[string]string{"quark": "-1"}, wantErr: true},
+		{in: map[string]string{"quark": "x"}, wantErr: true},
+		{in: map[string]string{"quark": "1:0"}, wantErr: true},
+		{in: map[string]string{"quark": "1:x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimits(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseRateLimits(%v) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRateLimits(%v) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketDone(t *testing.T) {
+	ctx := context.Background()
+	throttledErr := &fs.PathError{Op: "List", Path: "/", Err: ErrRateLimited}
+	b := newTokenBucket("test", &RateLimit{Rate: 8, Burst: 8})
+
+	// Each failure halves the rate down to the floor, once per backoff interval.
+	for _, want := range []float64{4, 2, 1, 0.5, 0.25, 0.25} {
+		b.lastBackoff = time.Time{}
+		b.done(ctx, throttledErr)
+		if b.rate != want {
+			t.Fatalf("rate = %v, want %v", b.rate, want)
+		}
+	}
+	b.done(ctx, throttledErr)
+	if b.rate != 0.25 {
+		t.Fatalf("rate = %v after failure within backoff interval, want 0.25", b.rate)
+	}
+	if got := testutil.ToFloat64(metricAlistRateLimit.WithLabelValues("test")); got != 0.25 {
+		t.Errorf("rate limit metric = %v, want 0.25", got)
+	}
+
+	// Each success recovers by a step up to the configured rate, as do answers that are
+	// not throttling.
+	for _, err := range []error{nil, fmt.Errorf("stat: %w", ErrNotFound), ErrUnauthorized, context.Canceled} {
+		b.done(ctx, err)
+	}
+	if b.rate != 2.25 {
+		t.Fatalf("rate = %v after 4 recoveries, want 2.25", b.rate)
+	}
+	for range 16 {
+		b.done(ctx, nil)
+	}
+	if b.rate != 8 {
+		t.Fatalf("rate = %v after recovery, want 8", b.rate)
+	}
+	if got := testutil.ToFloat64(metricAlistRateLimit.WithLabelValues("test")); got != 8 {
+		t.Errorf("rate limit metric = %v, want 8", got)
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := newTokenBucket("test", &RateLimit{Rate: 1, Burst: 2})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The burst is allowed at once.
+	for range 2 {
+		if err := b.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The next request is in debt, and waits until canceled.
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := b.wait(ctx); err != context.Canceled {
+		t.Errorf("wait = %v, want context.Canceled", err)
+	}
+	// The token taken by the canceled request is given back.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 0 {
+		t.Errorf("tokens = %v after cancel, want no debt", b.tokens)
+	}
+}
+
+func TestAlistClientBucket(t *testing.T) {
+	c := &AlistClient{RateLimits: map[string]*RateLimit{
+		"115 cloud": {Rate: 2, Burst: 2},
+		"default":   {Rate: 5, Burst: 5},
+	}}
+	c.learnProvider("/115/电影", "115 Cloud")
+	c.learnProvider("/quark", "Quark")
+
+	tests := []struct {
+		path     string
+		provider string
+		rate     float64
+	}{
+		{"/115/电影/a.mkv", "115 Cloud", 2},
+		{"/115/电视剧", "115 Cloud", 2},
+		{"/quark/a.mkv", "Quark", 5},
+		{"/unknown/a.mkv", "unknown", 5},
+	}
+	for _, tt := range tests {
+		b := c.bucket(tt.path)
+		if b == nil || b.provider != tt.provider || b.limit.Rate != tt.rate {
+			t.Errorf("bucket(%q) = %+v, want %s of rate %v", tt.path, b, tt.provider, tt.rate)
+		}
+	}
+	if b1, b2 := c.bucket("/115/a"), c.bucket("/115/b"); b1 != b2 {
+		t.Error("paths of a provider take different buckets")
+	}
+
+	if b := (&AlistClient{}).bucket("/115/a"); b != nil {
+		t.Errorf("bucket without rate limits = %+v, want nil", b)
+	}
+
+	// Without default, providers not configured take the built-in limit.
+	c = &AlistClient{RateLimits: map[string]*RateLimit{"115 cloud": {Rate: 2, Burst: 2}}}
+	c.learnProvider("/quark", "Quark")
+	for _, path := range []string{"/quark/a.mkv", "/unknown/a.mkv"} {
+		if b := c.bucket(path); b == nil || b.limit != builtinRateLimit {
+			t.Errorf("bucket(%q) without default = %+v, want built-in limit", path, b)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Modes of reconciling Emby items whose files no longer exist.
+const (
+	ReconcileOff     = "off"
+	ReconcileReport  = "report"
+	ReconcileRefresh = "refresh"
+	ReconcileRemove  = "remove"
+)
+
+// Actions done to dangling items.
+const (
+	danglingRefreshed = "refreshed"
+	danglingRemoved   = "removed"
+)
+
+const reconcileTimeout = 10 * time.Minute
+
+// DanglingItem is an Emby item under media directory whose file no longer exists.
+type DanglingItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Path is the path seen by Emby.
+	Path string `json:"path"`
+	// Action is "refreshed" or "removed" if done, or empty if only reported.
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// reconcileEmby finds Emby items left dangling under media directory, e.g. by a purge,
+// and refreshes or removes them as configured. Items are recorded in r. Failures are
+// logged only.
+func (cfg *Config) reconcileEmby(ctx context.Context, stages Stage, r *RunRecord) {
+	if cfg.EmbyURL == "" || cfg.EmbyReconcile == ReconcileOff || stages&StagePurge == 0 {
+		return
+	}
+	client, err := NewEmbyClient(cfg.EmbyURL, cfg.EmbyAPIKey)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid Emby url", "error", err)
+		return
+	}
+	mapping, err := parsePathMapping(cfg.EmbyPathMap)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid Emby path mapping", "error", err)
+		return
+	}
+	mediaDir, err := filepath.Abs(cfg.MediaDir)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid media directory", "error", err)
+		return
+	}
+
+	// Files are removed, so ghosts should be cleared even if ctx is canceled.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), reconcileTimeout)
+	defer cancel()
+
+	items, err := danglingItems(ctx, client, mapping, mapping.apply(mediaDir))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to find dangling Emby items", "error", err)
+		return
+	}
+	for _, item := range items {
+		switch cfg.EmbyReconcile {
+		case ReconcileRefresh:
+			err = client.RefreshItem(ctx, item.ID)
+			item.Action = danglingRefreshed
+		case ReconcileRemove:
+			// DELETE /Items/{id} would delete files too, while a deleted path is only
+			// removed from library.
+			err = client.Update(ctx, nil, []*MediaUpdate{{Path: item.Path, UpdateType: MediaDeleted}})
+			item.Action = danglingRemoved
+		default:
+			slog.InfoContext(ctx, "Dangling Emby item", "name", item.Name, "type", item.Type, "path", item.Path)
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to reconcile Emby item", "name", item.Name, "path", item.Path, "error", err)
+			item.Action, item.Error = "", err.Error()
+			continue
+		}
+		slog.InfoContext(ctx, "Reconciled dangling Emby item", "action", item.Action, "name", item.Name, "path", item.Path)
+	}
+	r.Dangling = items
+	if len(items) > 0 {
+		slog.InfoContext(ctx, "Dangling Emby items", "count", len(items), "mode", cfg.EmbyReconcile)
+	}
+}
+
+// danglingItems returns Emby items under root, the media directory seen by Emby, whose
+// files no longer exist. Items under a dangling folder are left out, as they go with it.
+func danglingItems(ctx context.Context, client *EmbyClient, mapping pathMapping, root string) ([]*DanglingItem, error) {
+	libs, err := client.Libraries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	under := func(p, dir string) bool {
+		return p == dir || strings.HasPrefix(p, dir+"/")
+	}
+
+	seen := make(map[string]bool)
+	var dangling []*DanglingItem
+	for _, lib := range libs {
+		overlaps := false
+		for _, loc := range lib.Locations {
+			loc = strings.TrimSuffix(loc, "/")
+			overlaps = overlaps || under(loc, root) || under(root, loc)
+		}
+		if !overlaps {
+			continue
+		}
+		items, err := client.Items(ctx, lib.ID)
+		if err != nil {
+			return nil, fmt.Errorf("list items of library %s: %w", lib.Name, err)
+		}
+		for _, item := range items {
+			if item.Path == "" || seen[item.ID] || !under(item.Path, root) {
+				continue
+			}
+			seen[item.ID] = true
+			if _, err := os.Stat(mapping.local(item.Path)); !errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			dangling = append(dangling, &DanglingItem{ID: item.ID, Name: item.Name, Type: item.Type, Path: item.Path})
+		}
+	}
+
+	sort.Slice(dangling, func(i, j int) bool { return dangling[i].Path < dangling[j].Path })
+	var top []*DanglingItem
+	for _, item := range dangling {
+		if n := len(top); n > 0 && item.Path != top[n-1].Path && under(item.Path, top[n-1].Path) {
+			continue
+		}
+		top = append(top, item)
+	}
+	return top, nil
+}
+
+func (cfg *Config) validateReconcile() error {
+	switch cfg.EmbyReconcile {
+	case ReconcileOff, ReconcileReport, ReconcileRefresh, ReconcileRemove:
+		return nil
+	}
+	return fmt.Errorf("invalid Emby reconcile mode: %s", cfg.EmbyReconcile)
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReconcileEmby(t *testing.T) {
+	mediaDir := t.TempDir()
+	for _, file := range []string{"电影/A/a.strm", "电影/B/b.nfo"} {
+		p := filepath.Join(mediaDir, file)
+		if err := os.MkdirAll(filepath.Dir(p), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, filePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := []*EmbyItem{
+		{ID: "a", Name: "A", Type: "Folder", Path: "/mnt/media/电影/A", IsFolder: true},
+		{ID: "a1", Name: "a", Type: "Movie", Path: "/mnt/media/电影/A/a.strm"},
+		// b.strm is purged, while its folder is left with b.nfo.
+		{ID: "b1", Name: "b", Type: "Movie", Path: "/mnt/media/电影/B/b.strm"},
+		// Gone is purged entirely, so its movie goes with it.
+		{ID: "g", Name: "Gone", Type: "Folder", Path: "/mnt/media/电影/Gone", IsFolder: true},
+		{ID: "g1", Name: "g", Type: "Movie", Path: "/mnt/media/电影/Gone/g.strm"},
+		// Items out of media directory, or without files, are not touched.
+		{ID: "o", Name: "Other", Type: "Movie", Path: "/mnt/other/o.strm"},
+		{ID: "v", Name: "Virtual", Type: "Episode"},
+	}
+
+	tests := []struct {
+		mode       string
+		wantAction string
+		wantPosts  []embyRequest
+	}{
+		{mode: ReconcileReport},
+		{
+			mode:       ReconcileRefresh,
+			wantAction: danglingRefreshed,
+			wantPosts: []embyRequest{
+				{Method: "POST", Path: "/Items/b1/Refresh", Token: "key"},
+				{Method: "POST", Path: "/Items/g/Refresh", Token: "key"},
+			},
+		},
+		{
+			mode:       ReconcileRemove,
+			wantAction: danglingRemoved,
+			wantPosts: []embyRequest{
+				{Method: "POST", Path: "/Library/Media/Updated", Token: "key", Body: `{"Updates":[{"Path":"/mnt/media/电影/B/b.strm","UpdateType":"Deleted"}]}`},
+				{Method: "POST", Path: "/Library/Media/Updated", Token: "key", Body: `{"Updates":[{"Path":"/mnt/media/电影/Gone","UpdateType":"Deleted"}]}`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			stub := newEmbyStub(t, "/mnt/media", items)
+			cfg := &Config{
+				MediaDir:      mediaDir,
+				EmbyURL:       stub.URL,
+				EmbyAPIKey:    "key",
+				EmbyPathMap:   []string{mediaDir + "=/mnt/media"},
+				EmbyReconcile: tt.mode,
+			}
+			rec := newRunRecord(StagePurge)
+
+			cfg.reconcileEmby(context.Background(), StagePurge, rec)
+
+			var got []string
+			for _, item := range rec.Dangling {
+				if item.Action != tt.wantAction || item.Error != "" {
+					t.Errorf("item %s: action = %q, error = %q, want action %q", item.ID, item.Action, item.Error, tt.wantAction)
+				}
+				got = append(got, item.ID)
+			}
+			sort.Strings(got)
+			if want := []string{"b1", "g"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("dangling items = %v, want %v", got, want)
+			}
+			posts := stub.posts()
+			sort.Slice(posts, func(i, j int) bool { return posts[i].Path+posts[i].Body < posts[j].Path+posts[j].Body })
+			if !reflect.DeepEqual(posts, tt.wantPosts) {
+				t.Errorf("requests = %+v, want %+v", posts, tt.wantPosts)
+			}
+		})
+	}
+}
+
+func TestReconcileEmbyWithoutPurge(t *testing.T) {
+	stub := newEmbyStub(t, "/media", nil)
+	cfg := &Config{MediaDir: t.TempDir(), EmbyURL: stub.URL, EmbyAPIKey: "key", EmbyReconcile: ReconcileRemove}
+
+	cfg.reconcileEmby(context.Background(), StageDownload|StageSync, newRunRecord(StageDownload|StageSync))
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if len(stub.requests) > 0 {
+		t.Errorf("requests = %+v, want none without purge", stub.requests)
+	}
+}
+
+func TestPurgeDone(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		stages Stage
+		err    error
+		want   bool
+	}{
+		{"purged", context.Background(), StageVerify | StagePurge, nil, true},
+		{"sync failed", context.Background(), StagePurge | StageSync, &StageError{Stage: StageSync, Err: errors.New("x")}, true},
+		{"purge failed", context.Background(), StagePurge | StageSync, &StageError{Stage: StagePurge, Err: errors.New("x")}, false},
+		{"verify failed", context.Background(), StageVerify | StagePurge, &StageError{Stage: StageVerify, Err: errors.New("x")}, false},
+		{"canceled", canceled, StagePurge | StageSync, &StageError{Stage: StageSync, Err: context.Canceled}, false},
+		{"without purge", context.Background(), StageDownload | StageSync, nil, false},
+	}
+	for _, tt := range tests {
+		if got := purgeDone(tt.ctx, tt.stages, tt.err); got != tt.want {
+			t.Errorf("%s: purgeDone = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Verdicts of verifying a strm target on Alist. A target is unknown if Alist fails to
+// answer whether it exists, e.g. on a network error or rate limiting.
+const (
+	VerdictPresent = "present"
+	VerdictAbsent  = "absent"
+	VerdictUnknown = "unknown"
+)
+
+// VerifyReport is the result of verifying strm targets on Alist, grouped by root directory.
+type VerifyReport struct {
+	Time  time.Time                    `json:"time"`
+	Roots map[string]*VerifyReportRoot `json:"roots"`
+
+	// verdicts holds the verdict of each verified strm file.
+	verdicts map[string]string
+	// streaks holds the number of consecutive absent verdicts of each verified strm file.
+	streaks map[string]int
+	// strms holds all strm files in metadata, verified or not.
+	strms map[string]bool
+}
+
+// VerifyReportRoot is the verification result of a root directory.
+type VerifyReportRoot struct {
+	Present int      `json:"present"`
+	Skipped int      `json:"skipped"`
+	Absent  []string `json:"absent"`
+	Unknown []string `json:"unknown"`
+}
+
+func newVerifyReport() *VerifyReport {
+	return &VerifyReport{
+		Time:     time.Now(),
+		Roots:    make(map[string]*VerifyReportRoot),
+		verdicts: make(map[string]string),
+		streaks:  make(map[string]int),
+		strms:    make(map[string]bool),
+	}
+}
+
+func (r *VerifyReport) root(strm string) *VerifyReportRoot {
+	name := getRootDir(strm, "/")
+	root := r.Roots[name]
+	if root == nil {
+		root = &VerifyReportRoot{Absent: []string{}, Unknown: []string{}}
+		r.Roots[name] = root
+	}
+	return root
+}
+
+func (r *VerifyReport) present(strm string) {
+	r.root(strm).Present++
+	r.verdicts[strm] = VerdictPresent
+}
+
+func (r *VerifyReport) skipped(strm string) {
+	r.root(strm).Skipped++
+}
+
+func (r *VerifyReport) absent(strm string) {
+	root := r.root(strm)
+	root.Absent = append(root.Absent, strm)
+	r.verdicts[strm] = VerdictAbsent
+}
+
+func (r *VerifyReport) unknown(strm string) {
+	root := r.root(strm)
+	root.Unknown = append(root.Unknown, strm)
+	r.verdicts[strm] = VerdictUnknown
+}
+
+// summary returns the number of strm files in each state of each root.
+func (r *VerifyReport) summary() map[string]map[string]int {
+	m := make(map[string]map[string]int, len(r.Roots))
+	for name, root := range r.Roots {
+		m[name] = map[string]int{
+			"present": root.Present,
+			"absent":  len(root.Absent),
+			"unknown": len(root.Unknown),
+			"skipped": root.Skipped,
+		}
+	}
+	return m
+}
+
+// WriteFile writes the report to path as JSON.
+func (r *VerifyReport) WriteFile(path string) error {
+	for _, root := range r.Roots {
+		sort.Strings(root.Absent)
+		sort.Strings(root.Unknown)
+	}
+
+	p, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(p, '\n'), filePerm)
+}
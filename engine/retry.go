@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	defaultRetryAttempts   = 5
+	defaultRetryBackoff    = 5 * time.Second
+	defaultRetryMaxBackoff = 5 * time.Minute
+	defaultRetryJitter     = 0.2
+)
+
+// RetryPolicy controls how a failed stage is retried within a cycle.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It is doubled after each retry.
+	Backoff time.Duration
+	// MaxBackoff is the upper limit of the delay.
+	MaxBackoff time.Duration
+}
+
+func defaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: defaultRetryAttempts,
+		Backoff:     defaultRetryBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+	}
+}
+
+// delay returns the delay after the given failed attempt, which starts from 1. The delay
+// is randomized by jitter, a fraction of the delay.
+func (p *RetryPolicy) delay(attempt int, jitter float64) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * jitter * float64(d))
+	}
+	return d
+}
+
+func (p *RetryPolicy) validate(stage Stage) error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("retry attempts of %s stage must be at least 1", stage)
+	}
+	if p.Backoff <= 0 || p.MaxBackoff < p.Backoff {
+		return fmt.Errorf("retry backoff of %s stage must be positive and not exceed max backoff", stage)
+	}
+	return nil
+}
+
+// retryPolicy returns the retry policy of stage.
+func (cfg *Config) retryPolicy(stage Stage) *RetryPolicy {
+	if p := cfg.RetryPolicies[stage]; p != nil {
+		return p
+	}
+	return defaultRetryPolicy()
+}
+
+// try runs fn of stage until it succeeds, ctx is canceled, or the retry policy of stage
+// is exhausted.
+func (cfg *Config) try(ctx context.Context, stage Stage, fn func() error) error {
+	cfg.stage.Store(int64(stage))
+	policy := cfg.retryPolicy(stage)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			slog.ErrorContext(ctx, "Stage failed", "attempts", attempt, "error", err)
+			return err
+		}
+
+		d := policy.delay(attempt, cfg.RetryJitter)
+		slog.ErrorContext(ctx, "Stage failed, will retry", "attempt", attempt, "max_attempts", policy.MaxAttempts, "error", err, "retry_in", d.Round(time.Millisecond))
+		if err := sleepContext(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// bindRetryFlags binds flags of retry policies for the given stages.
+func (cfg *Config) bindRetryFlags(flags *pflag.FlagSet, stages Stage) {
+	if cfg.RetryPolicies == nil {
+		cfg.RetryPolicies = make(map[Stage]*RetryPolicy)
+	}
+	for _, each := range stageNames {
+		if !stages.Has(each.stage) {
+			continue
+		}
+		p := cfg.RetryPolicies[each.stage]
+		if p == nil {
+			p = defaultRetryPolicy()
+			cfg.RetryPolicies[each.stage] = p
+		}
+		flags.IntVar(&p.MaxAttempts, each.name+"-retry-attempts", defaultRetryAttempts, fmt.Sprintf("Maximum attempts of %s stage in a cycle, one-shot commands included. 1 to fail at once.", each.name))
+		flags.DurationVar(&p.Backoff, each.name+"-retry-backoff", defaultRetryBackoff, fmt.Sprintf("Delay before retrying %s stage, doubled after each retry.", each.name))
+		flags.DurationVar(&p.MaxBackoff, each.name+"-retry-max-backoff", defaultRetryMaxBackoff, fmt.Sprintf("Maximum delay before retrying %s stage.", each.name))
+	}
+	flags.Float64Var(&cfg.RetryJitter, "retry-jitter", defaultRetryJitter, "Random jitter of retry delays, as a fraction of the delay.")
+}
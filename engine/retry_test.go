@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTry(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name        string
+		maxAttempts int
+		failures    int
+		wantCalls   int
+		wantErr     error
+	}{
+		{"fail at once", 1, 5, 1, errFailed},
+		{"exhausted", 3, 5, 3, errFailed},
+		{"recovered", 3, 2, 3, nil},
+		{"succeeded", 3, 0, 1, nil},
+	}
+	for _, tt := range tests {
+		cfg := &Config{RetryPolicies: map[Stage]*RetryPolicy{
+			StageSync: {MaxAttempts: tt.maxAttempts, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		}}
+		calls := 0
+		err := cfg.try(context.Background(), StageSync, func() error {
+			calls++
+			if calls <= tt.failures {
+				return errFailed
+			}
+			return nil
+		})
+		if calls != tt.wantCalls || err != tt.wantErr {
+			t.Errorf("%s: calls, err = %d, %v, want %d, %v", tt.name, calls, err, tt.wantCalls, tt.wantErr)
+		}
+	}
+}
+
+func TestTryCanceled(t *testing.T) {
+	cfg := &Config{RetryPolicies: map[Stage]*RetryPolicy{
+		StageSync: {MaxAttempts: 3, Backoff: time.Hour, MaxBackoff: time.Hour},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	calls := 0
+	err := cfg.try(ctx, StageSync, func() error {
+		calls++
+		return errors.New("failed")
+	})
+	if calls != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("calls, err = %d, %v, want 1, context.Canceled", calls, err)
+	}
+}
+
+// TestRunStagesFailFast checks that a one-shot run with a single attempt fails at once,
+// instead of waiting for a retry.
+func TestRunStagesFailFast(t *testing.T) {
+	downloadDir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(downloadDir, ".metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createFileTable(db); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateToDB(tx, &MetadataFile{path: "/电影/a.strm", name: "a.strm"}); err != nil {
+		t.Fatal(err)
+	}
+	// A strm file that cannot be read fails the verify stage.
+	if err := os.MkdirAll(filepath.Join(downloadDir, "电影", "a.strm"), dirPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{
+		DownloadDir: downloadDir,
+		MediaDir:    t.TempDir(),
+		RetryPolicies: map[Stage]*RetryPolicy{
+			StageVerify: {MaxAttempts: 1, Backoff: time.Hour, MaxBackoff: time.Hour},
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- cfg.runStages(context.Background(), StageVerify) }()
+
+	select {
+	case err := <-done:
+		var serr *StageError
+		if !errors.As(err, &serr) || serr.Stage != StageVerify {
+			t.Errorf("runStages = %v, want verify stage error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runStages retried the verify stage with a single attempt")
+	}
+}
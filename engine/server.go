@@ -0,0 +1,286 @@
+package engine
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serve serves the HTTP API of daemon on listener until ctx is canceled.
+func (cfg *Config) serve(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", cfg.authorize(cfg.handleStatus))
+	mux.HandleFunc("GET /api/runs", cfg.authorize(cfg.handleRuns))
+	mux.HandleFunc("GET /api/changes", cfg.authorize(cfg.handleChanges))
+	mux.HandleFunc("GET /api/mirrors", cfg.authorize(cfg.handleMirrors))
+	mux.HandleFunc("POST /api/run", cfg.authorizeControl(cfg.handleRun))
+	mux.HandleFunc("POST /api/pause", cfg.authorizeControl(cfg.handlePause))
+	mux.HandleFunc("POST /api/resume", cfg.authorizeControl(cfg.handleResume))
+	mux.HandleFunc("POST /api/cancel", cfg.authorizeControl(cfg.handleCancel))
+	mux.HandleFunc("GET /healthz", cfg.handleHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handleReadyz)
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.Handle("GET /", dashboardHandler())
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if cfg.APIToken == "" {
+		slog.Warn("HTTP API is read-only and not protected, set --api-token to require a bearer token and enable run, pause, resume and cancel")
+	}
+	slog.Info("Serving HTTP API", "address", listener.Addr().String())
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP API stopped", "error", err)
+	}
+}
+
+// authorize requires the bearer token of API, if it is set.
+func (cfg *Config) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.APIToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="xiaoya-emby"`)
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// authorizeControl requires the bearer token of API to control the daemon. Without the
+// token set, the daemon cannot be controlled over HTTP at all.
+func (cfg *Config) authorizeControl(h http.HandlerFunc) http.HandlerFunc {
+	authorized := cfg.authorize(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIToken == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "control API is disabled, set --api-token to enable it"})
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// Status is the status of daemon.
+type Status struct {
+	Running bool `json:"running"`
+	Paused  bool `json:"paused"`
+	// RunID, Stages, Started, Stage and Progress are of the running cycle.
+	RunID    string          `json:"run_id,omitempty"`
+	Stages   string          `json:"stages,omitempty"`
+	Started  *time.Time      `json:"started,omitempty"`
+	Stage    string          `json:"stage,omitempty"`
+	Progress *ProgressStatus `json:"progress,omitempty"`
+	LastRun  *RunRecord      `json:"last_run,omitempty"`
+	// NextRun is the earliest next scheduled time of all schedules.
+	NextRun   *time.Time        `json:"next_run,omitempty"`
+	Schedules []*ScheduleStatus `json:"schedules"`
+}
+
+// ScheduleStatus is the status of a schedule of daemon.
+type ScheduleStatus struct {
+	// Name is empty if all stages run in a single schedule.
+	Name   string     `json:"name,omitempty"`
+	Stages string     `json:"stages"`
+	Cron   string     `json:"cron"`
+	Next   *time.Time `json:"next,omitempty"`
+}
+
+// Status returns the status of daemon.
+func (cfg *Config) Status() *Status {
+	s := &Status{Schedules: []*ScheduleStatus{}}
+	if r := cfg.current.Load(); r != nil {
+		s.Running = true
+		s.RunID, s.Stages, s.Started = r.RunID, r.Stages, &r.Start
+		if stage := Stage(cfg.stage.Load()); stage != 0 {
+			s.Stage = stage.String()
+		}
+		if p := cfg.progress.Load(); p != nil {
+			s.Progress = p.status()
+		}
+	}
+
+	s.LastRun = cfg.lastRun.Load()
+	if s.LastRun == nil {
+		if runs, err := cfg.listRuns(1); err != nil {
+			slog.Warn("Failed to load run history", "error", err)
+		} else if len(runs) > 0 {
+			s.LastRun = runs[0]
+		}
+	}
+
+	if d := cfg.getDaemon(); d != nil {
+		s.Paused = d.paused.Load()
+		for _, each := range d.schedules {
+			ss := &ScheduleStatus{Name: each.name, Stages: each.stages.String(), Cron: each.spec}
+			if next := d.next(each); !next.IsZero() {
+				ss.Next = &next
+				if s.NextRun == nil || next.Before(*s.NextRun) {
+					s.NextRun = &next
+				}
+			}
+			s.Schedules = append(s.Schedules, ss)
+		}
+	}
+	return s
+}
+
+func (cfg *Config) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cfg.Status())
+}
+
+// handleRun starts a cycle of the first schedule, or of the given stages, e.g.
+// "?stages=verify,sync".
+func (cfg *Config) handleRun(w http.ResponseWriter, r *http.Request) {
+	var started bool
+	if s := r.FormValue("stages"); s != "" {
+		stages, err := parseScheduleStages(strings.Split(s, ","))
+		if err == nil {
+			started, err = cfg.RunStages(stages)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	} else {
+		started = cfg.RunNow()
+	}
+
+	status := "started"
+	if !started {
+		status = "coalesced"
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": status})
+}
+
+func (cfg *Config) handleRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := cfg.listRuns(queryInt(r, "limit", 20))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if runs == nil {
+		runs = []*RunRecord{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// handleChanges lists files changed in media directory, filtered by "action", "prefix"
+// of path, and time range "since" and "until", and paged by "before" ID.
+func (cfg *Config) handleChanges(w http.ResponseWriter, r *http.Request) {
+	filter := changeFilter{
+		Action: r.FormValue("action"),
+		Prefix: r.FormValue("prefix"),
+		Before: int64(queryInt(r, "before", 0)),
+		Limit:  queryInt(r, "limit", 100),
+	}
+	var err error
+	if s := r.FormValue("since"); s != "" {
+		filter.Since, err = parseTime(s)
+	}
+	if s := r.FormValue("until"); s != "" && err == nil {
+		filter.Until, err = parseTime(s)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	changes, err := cfg.listChanges(filter)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// handleMirrors returns the health of mirrors as ranked by the last validation.
+func (cfg *Config) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	var health []*MirrorHealth
+	if h := lastMirrorHealth.Load(); h != nil {
+		health = *h
+	} else {
+		var err error
+		if health, err = cfg.loadMirrorHealth(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if health == nil {
+		health = []*MirrorHealth{}
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (cfg *Config) handlePause(w http.ResponseWriter, r *http.Request) {
+	cfg.Pause()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "paused"})
+}
+
+func (cfg *Config) handleResume(w http.ResponseWriter, r *http.Request) {
+	cfg.Resume()
+	writeJSON(w, http.StatusOK, map[string]string{"status": "resumed"})
+}
+
+func (cfg *Config) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Cancel() {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "idle"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "canceling"})
+}
+
+// handleHealthz reports that daemon is alive.
+func (cfg *Config) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether daemon has started scheduling, and the download directory
+// is accessible.
+func (cfg *Config) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if d := cfg.getDaemon(); d == nil || !d.started.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	if _, err := os.Stat(cfg.DownloadDir); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// queryInt returns a positive integer of query parameter, or def if it is absent or
+// invalid.
+func queryInt(r *http.Request, key string, def int) int {
+	n, err := strconv.Atoi(r.FormValue(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
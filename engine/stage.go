@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stage is a step of the metadata pipeline. Stages can be combined as a bitmask whose
+// lower bits are compatible with the legacy --mode flag.
+type Stage int
+
+const (
+	// StageSync copies updated metadata from download directory to media directory.
+	StageSync Stage = 1 << iota
+	// StageVerify verifies strm targets on Alist.
+	StageVerify
+	// StageDownload downloads metadata from mirrors to download directory.
+	StageDownload
+	// StagePurge removes files no longer available from media directory.
+	StagePurge
+
+	stagesAll = StageSync | StageVerify | StageDownload | StagePurge
+)
+
+// Exit codes of the command line.
+const (
+	ExitCodeOK              = 0
+	ExitCodeInvalidOptions  = 2
+	ExitCodeLocked          = 3
+	ExitCodeDownload        = 125
+	ExitCodeVerify          = 126
+	ExitCodePurge           = 127
+	ExitCodeSync            = 128
+	ExitCodeShutdownTimeout = 130
+)
+
+var stageNames = []struct {
+	stage Stage
+	name  string
+}{
+	{StageDownload, "download"},
+	{StageVerify, "verify"},
+	{StagePurge, "purge"},
+	{StageSync, "sync"},
+}
+
+func (s Stage) String() string {
+	var ss []string
+	for _, each := range stageNames {
+		if s&each.stage != 0 {
+			ss = append(ss, each.name)
+		}
+	}
+	if len(ss) == 0 {
+		return "none"
+	}
+	return strings.Join(ss, "+")
+}
+
+// Has reports whether all stages of t are included in s.
+func (s Stage) Has(t Stage) bool {
+	return s&t == t
+}
+
+// first returns the first stage of s to run in the pipeline.
+func (s Stage) first() Stage {
+	for _, each := range stageNames {
+		if s&each.stage != 0 {
+			return each.stage
+		}
+	}
+	return 0
+}
+
+// ExitCode returns the exit code when the stage fails.
+func (s Stage) ExitCode() int {
+	switch {
+	case s.Has(StageDownload):
+		return ExitCodeDownload
+	case s.Has(StageVerify):
+		return ExitCodeVerify
+	case s.Has(StagePurge):
+		return ExitCodePurge
+	case s.Has(StageSync):
+		return ExitCodeSync
+	}
+	return ExitCodeOK
+}
+
+// stagesFromMode converts the legacy --mode bitmask to stages.
+func stagesFromMode(mode int) Stage {
+	var stages Stage
+	if mode&4 == 4 {
+		stages |= StageDownload
+	}
+	if mode&2 == 2 {
+		stages |= StageVerify
+	}
+	if mode&1 == 1 {
+		stages |= StagePurge | StageSync
+	}
+	return stages
+}
+
+// StageError is returned when a stage of the pipeline fails.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s stage failed: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code of the failed stage.
+func (e *StageError) ExitCode() int {
+	return e.Stage.ExitCode()
+}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	stateDBName = ".state.db"
+
+	stateKeyLastSuccess  = "last_success"
+	stateKeyMirrorHealth = "mirror_health"
+)
+
+// openStateDB opens the state DB of daemon, which lives in download directory.
+func (cfg *Config) openStateDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(cfg.DownloadDir, stateDBName))
+	if err != nil {
+		return nil, err
+	}
+	if err := createStateTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func createStateTable(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS state (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS verdicts (
+		path TEXT PRIMARY KEY,
+		verdict TEXT,
+		verified_at INTEGER,
+		absent_streak INTEGER NOT NULL DEFAULT 0
+	)`); err != nil {
+		return err
+	}
+	if err := createRunTable(db); err != nil {
+		return err
+	}
+	return createChangeTable(db)
+}
+
+// lastSuccess returns the time of last successful run of a schedule, or zero time if none.
+func (cfg *Config) lastSuccess(schedule string) (time.Time, error) {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	var s string
+	err = db.QueryRow("SELECT value FROM state WHERE key = ?", lastSuccessKey(schedule)).Scan(&s)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (cfg *Config) saveLastSuccess(schedule string, t time.Time) error {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT OR REPLACE INTO state VALUES (?,?)", lastSuccessKey(schedule), t.Format(time.RFC3339Nano))
+	return err
+}
+
+func lastSuccessKey(schedule string) string {
+	if schedule == "" {
+		return stateKeyLastSuccess
+	}
+	return stateKeyLastSuccess + "_" + schedule
+}
+
+// verdictRecord is the recorded verdict of a strm file.
+type verdictRecord struct {
+	Verdict    string
+	VerifiedAt time.Time
+	// AbsentStreak is the number of consecutive absent verdicts. Unknown verdicts
+	// neither break nor extend it.
+	AbsentStreak int
+}
+
+// absentStreak returns the number of consecutive absent verdicts, given verdict follows
+// the recorded one, if any.
+func absentStreak(last *verdictRecord, verdict string) int {
+	streak := 0
+	if last != nil {
+		streak = last.AbsentStreak
+	}
+	switch verdict {
+	case VerdictAbsent:
+		return streak + 1
+	case VerdictUnknown:
+		return streak
+	}
+	return 0
+}
+
+// saveVerdicts records verdicts of report. Verdicts of strm files not verified, e.g.
+// skipped, are kept along with their absent streaks, while those of strm files no longer
+// in metadata are removed.
+func (cfg *Config) saveVerdicts(report *VerifyReport) error {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT path FROM verdicts")
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		if !report.strms[path] {
+			gone = append(gone, path)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, path := range gone {
+		if _, err := tx.Exec("DELETE FROM verdicts WHERE path = ?", path); err != nil {
+			return err
+		}
+	}
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO verdicts (path, verdict, verified_at, absent_streak) VALUES (?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for path, verdict := range report.verdicts {
+		if _, err := stmt.Exec(path, verdict, report.Time.Unix(), report.streaks[path]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadVerdicts returns recorded verdicts of the last verification.
+func (cfg *Config) loadVerdicts() (map[string]*verdictRecord, error) {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT path, verdict, verified_at, absent_streak FROM verdicts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	verdicts := make(map[string]*verdictRecord)
+	for rows.Next() {
+		var (
+			path       string
+			r          = &verdictRecord{}
+			verifiedAt int64
+		)
+		if err := rows.Scan(&path, &r.Verdict, &verifiedAt, &r.AbsentStreak); err != nil {
+			return nil, err
+		}
+		r.VerifiedAt = time.Unix(verifiedAt, 0)
+		verdicts[path] = r
+	}
+	return verdicts, rows.Err()
+}
+
+// saveMirrorHealth records the health of mirrors as of the last validation.
+func (cfg *Config) saveMirrorHealth(health []*MirrorHealth) error {
+	p, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT OR REPLACE INTO state VALUES (?,?)", stateKeyMirrorHealth, string(p))
+	return err
+}
+
+// loadMirrorHealth returns the recorded health of mirrors, or nil if none.
+func (cfg *Config) loadMirrorHealth() ([]*MirrorHealth, error) {
+	db, err := cfg.openStateDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var s string
+	err = db.QueryRow("SELECT value FROM state WHERE key = ?", stateKeyMirrorHealth).Scan(&s)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var health []*MirrorHealth
+	if err := json.Unmarshal([]byte(s), &health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSaveVerdicts(t *testing.T) {
+	cfg := &Config{DownloadDir: t.TempDir()}
+
+	first := newVerifyReport()
+	for _, strm := range []string{"/电影/a.strm", "/电影/b.strm", "/动漫/c.strm", "/动漫/d.strm"} {
+		first.strms[strm] = true
+		first.absent(strm)
+		first.streaks[strm] = 2
+	}
+	if err := cfg.saveVerdicts(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// /动漫 is skipped this time, and /电影/b.strm is no longer in metadata.
+	second := newVerifyReport()
+	second.strms["/电影/a.strm"] = true
+	second.present("/电影/a.strm")
+	for _, strm := range []string{"/动漫/c.strm", "/动漫/d.strm"} {
+		second.strms[strm] = true
+		second.skipped(strm)
+	}
+	if err := cfg.saveVerdicts(second); err != nil {
+		t.Fatal(err)
+	}
+
+	verdicts, err := cfg.loadVerdicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]verdictRecord, len(verdicts))
+	for path, r := range verdicts {
+		got[path] = verdictRecord{Verdict: r.Verdict, AbsentStreak: r.AbsentStreak}
+	}
+	want := map[string]verdictRecord{
+		"/电影/a.strm": {Verdict: VerdictPresent},
+		"/动漫/c.strm": {Verdict: VerdictAbsent, AbsentStreak: 2},
+		"/动漫/d.strm": {Verdict: VerdictAbsent, AbsentStreak: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("verdicts = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,221 @@
+"use strict";
+
+const $ = (sel) => document.querySelector(sel);
+
+let token = localStorage.getItem("xiaoya-emby-token") || "";
+let oldestChange = 0;
+
+async function api(method, path) {
+  const headers = {};
+  if (token) {
+    headers.Authorization = "Bearer " + token;
+  }
+  const resp = await fetch(path, { method, headers });
+  const body = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+function showError(err) {
+  const el = $("#error");
+  el.hidden = !err;
+  el.textContent = err ? String(err.message || err) : "";
+}
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  if (cls) {
+    td.className = cls;
+  }
+  return td;
+}
+
+function fillTable(sel, rows, render) {
+  const tbody = $(sel + " tbody");
+  tbody.replaceChildren();
+  appendRows(tbody, rows, render);
+}
+
+function appendRows(tbody, rows, render) {
+  for (const row of rows) {
+    const tr = document.createElement("tr");
+    tr.append(...render(row));
+    tbody.append(tr);
+  }
+}
+
+function fmtTime(s) {
+  return s ? new Date(s).toLocaleString() : "-";
+}
+
+function fmtDuration(secs) {
+  secs = Math.round(secs);
+  const h = Math.floor(secs / 3600);
+  const m = Math.floor((secs % 3600) / 60);
+  const s = secs % 60;
+  return (h ? h + "h" : "") + (h || m ? m + "m" : "") + s + "s";
+}
+
+function fmtBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function fmtSizeChange(c) {
+  const size = (n) => (n === undefined ? "-" : fmtBytes(n));
+  return c.action === "updated" ? `${size(c.old_size)} → ${size(c.new_size)}` : size(c.new_size ?? c.old_size);
+}
+
+function sumChanges(changes, key) {
+  return Object.values(changes || {}).reduce((n, c) => n + c[key], 0);
+}
+
+async function refreshStatus() {
+  const s = await api("GET", "api/status");
+  $("#state").textContent = (s.running ? "running" : "idle") + (s.paused ? ", paused" : "");
+  $("#run").textContent = s.running ? `${s.run_id} (${s.stages}) since ${fmtTime(s.started)}` : "-";
+  $("#stage").textContent = s.stage || "-";
+  $("#next-run").textContent = s.paused ? "paused" : fmtTime(s.next_run);
+  $("#pause").textContent = s.paused ? "Resume" : "Pause";
+  $("#pause").dataset.paused = s.paused ? "1" : "";
+
+  const p = s.progress;
+  $("#progress").hidden = !p;
+  if (p) {
+    const processed = p.done + p.skipped + p.failed;
+    $("#progress-bar").max = Math.max(p.total, 1);
+    $("#progress-bar").value = processed;
+    let text = `${p.task}: ${processed} / ${p.total || "?"}, ${p.done} done, ${p.skipped} skipped, ${p.failed} failed, ${fmtBytes(p.bytes)}, elapsed ${fmtDuration(p.elapsed)}`;
+    if (p.eta !== undefined) {
+      text += `, ETA ${fmtDuration(p.eta)}`;
+    }
+    $("#progress-text").textContent = text;
+  }
+}
+
+async function refreshMirrors() {
+  const mirrors = await api("GET", "api/mirrors");
+  fillTable("#mirrors", mirrors, (m) => [
+    cell(m.valid ? m.rank : "invalid", m.valid ? "ok" : "bad"),
+    cell(m.url),
+    cell(m.valid ? Math.round(m.latency * 1000) + " ms" : "-", "num"),
+    cell(m.probes + " / 5", "num"),
+    cell(fmtTime(m.checked)),
+  ]);
+}
+
+async function refreshRuns() {
+  const runs = await api("GET", "api/runs?limit=20");
+  fillTable("#runs", runs, (r) => [
+    cell(r.id, "num"),
+    cell(r.run_id),
+    cell(fmtTime(r.start)),
+    cell(fmtDuration((new Date(r.end) - new Date(r.start)) / 1000)),
+    cell(r.stages),
+    cell(r.downloaded, "num"),
+    cell(r.skipped, "num"),
+    cell(r.failed, "num"),
+    cell(sumChanges(r.changes, "added"), "num"),
+    cell(sumChanges(r.changes, "updated"), "num"),
+    cell(sumChanges(r.changes, "removed"), "num"),
+    cell((r.dangling || []).length, "num"),
+    cell(r.error, "path bad"),
+  ]);
+
+  // Valid directories are counted by runs that verified or purged.
+  const run = runs.find((r) => Object.keys(r.valid_dirs || {}).length > 0);
+  $("#roots-note").textContent = run ? `As of run ${run.run_id} at ${fmtTime(run.end)}` : "No verified run yet";
+  const roots = run ? Object.entries(run.valid_dirs).sort((a, b) => a[0].localeCompare(b[0])) : [];
+  fillTable("#roots", roots, ([root, n]) => [cell(root), cell(n, "num")]);
+}
+
+async function loadChanges(more) {
+  const params = new URLSearchParams({ limit: "100" });
+  const action = $("#changes-action").value;
+  const prefix = $("#changes-prefix").value.trim();
+  if (action) {
+    params.set("action", action);
+  }
+  if (prefix) {
+    params.set("prefix", prefix);
+  }
+  if (more && oldestChange) {
+    params.set("before", String(oldestChange));
+  }
+  const changes = await api("GET", "api/changes?" + params);
+  const tbody = $("#changes tbody");
+  if (!more) {
+    tbody.replaceChildren();
+  }
+  appendRows(tbody, changes, (c) => [
+    cell(fmtTime(c.time)),
+    cell(c.action, c.action),
+    cell(c.path, "path"),
+    cell(fmtSizeChange(c), "num"),
+    cell(c.reason),
+    cell(c.run_id),
+  ]);
+  if (changes.length > 0) {
+    oldestChange = changes[changes.length - 1].id;
+  }
+  $("#changes-more").hidden = changes.length < 100;
+}
+
+async function refreshAll() {
+  try {
+    await Promise.all([refreshStatus(), refreshMirrors(), refreshRuns(), loadChanges(false)]);
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function action(method, path) {
+  try {
+    await api(method, path);
+    showError(null);
+    setTimeout(refreshAll, 500);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+$("#token").value = token;
+$("#token-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = $("#token").value.trim();
+  localStorage.setItem("xiaoya-emby-token", token);
+  refreshAll();
+});
+
+for (const btn of document.querySelectorAll("[data-run]")) {
+  btn.addEventListener("click", () => {
+    const stages = btn.dataset.run;
+    action("POST", "api/run" + (stages ? "?stages=" + encodeURIComponent(stages) : ""));
+  });
+}
+$("#pause").addEventListener("click", (e) => {
+  action("POST", e.target.dataset.paused ? "api/resume" : "api/pause");
+});
+$("#cancel").addEventListener("click", () => {
+  if (confirm("Cancel the running cycle?")) {
+    action("POST", "api/cancel");
+  }
+});
+$("#changes-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  loadChanges(false).catch(showError);
+});
+$("#changes-more").addEventListener("click", () => loadChanges(true).catch(showError));
+
+refreshAll();
+setInterval(() => refreshStatus().then(() => showError(null), showError), 3000);
+setInterval(() => Promise.all([refreshMirrors(), refreshRuns()]).catch(showError), 30000);
@@ -1,8 +1,10 @@
 #!/bin/bash
 
-ALIST_STRM_ROOT_PATH=${ALIST_STRM_ROOT_PATH:-"/d"}
-ALIST_URL=${ALIST_URL:-"http://xiaoya.host:5678"}
-RUN_CRON_EXPR=${RUN_CRON_EXPR:-"0 0 * * *"}
+# Legacy variables are passed on only if set, leaving defaults to the flags, so that a
+# config file is not overridden. They are passed as environment variables rather than
+# flags, so that subcommands without these flags, e.g. "history", still work.
+[ -n "${ALIST_STRM_ROOT_PATH+x}" ] && export XIAOYA_EMBY_ALIST_STRM_ROOT_PATH=${XIAOYA_EMBY_ALIST_STRM_ROOT_PATH-$ALIST_STRM_ROOT_PATH}
+[ -n "${ALIST_URL+x}" ] && export XIAOYA_EMBY_ALIST_URL=${XIAOYA_EMBY_ALIST_URL-$ALIST_URL}
+[ -n "${RUN_CRON_EXPR+x}" ] && export XIAOYA_EMBY_CRON_EXPR=${XIAOYA_EMBY_CRON_EXPR-$RUN_CRON_EXPR}
 
-
-/app/bin/xiaoya-emby -r "${ALIST_STRM_ROOT_PATH}" -u "${ALIST_URL}" --cron-expr "${RUN_CRON_EXPR}" "$@"
\ No newline at end of file
+exec /app/bin/xiaoya-emby "$@"
\ No newline at end of file
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/universonic/xiaoya-emby/engine"
 )
 
@@ -9,5 +11,7 @@ var (
 )
 
 func main() {
-	cfg.Command().Execute()
+	if err := cfg.Command().Execute(); err != nil {
+		os.Exit(engine.ExitCodeInvalidOptions)
+	}
 }